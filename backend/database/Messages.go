@@ -1,44 +1,71 @@
 package database
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 )
 
+// ErrUserNotFound is returned when a chat target does not exist
+var ErrUserNotFound = errors.New("user not found")
+
 // Define Message struct with correct field names
 type Message struct {
-	MessageID int    `json:"message_id"`
-	Sender    string `json:"sender"`
-	Recipient string `json:"recipient"`
-	Message   string `json:"message"`
-	Timestamp string `json:"timestamp"`
+	MessageID   int     `json:"message_id"`
+	Sender      string  `json:"sender"`
+	Recipient   string  `json:"recipient"`
+	Message     string  `json:"message"`
+	Timestamp   string  `json:"timestamp"`
+	DeliveredAt *string `json:"delivered_at,omitempty"`
+	ReadAt      *string `json:"read_at,omitempty"`
+	EditedAt    *string `json:"edited_at,omitempty"`
+	DeletedAt   *string `json:"deleted_at,omitempty"`
+	Deleted     bool    `json:"deleted"`
+
+	// ConversationID is set for every message; Recipient is empty for
+	// messages in multi-party conversations
+	ConversationID *int `json:"conversation_id,omitempty"`
+
+	Attachments []Attachment      `json:"attachments,omitempty"`
+	Reactions   []ReactionSummary `json:"reactions,omitempty"`
 }
 
-// Save a message to the database
-func SaveMessage(recipient, sender, message, timestamp string) error {
-	query := `INSERT INTO messages (recipient, sender, message, timestamp) 
-             VALUES (?, ?, ?, ?)`
-	result, err := Db.Exec(query, recipient, sender, message, timestamp)
+// Save a message together with the sender's uploaded attachments and return
+// its message_id and attachments
+func SaveMessage(recipient, sender, message, timestamp string, attachmentIDs []int) (int, []Attachment, error) {
+	conversationID, err := GetOrCreateDirectConversation(sender, recipient)
 	if err != nil {
-		return fmt.Errorf("failed to save message: %v", err)
+		return 0, nil, fmt.Errorf("failed to save message: %v", err)
 	}
 
-	rows, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("error checking rows affected: %v", err)
-	}
+	query := `INSERT INTO messages (recipient, sender, message, timestamp, conversation_id) 
+             VALUES (?, ?, ?, ?, ?)`
+	return saveWithAttachments("message_id", attachmentIDs, sender, func(tx *sql.Tx) (sql.Result, error) {
+		return tx.Exec(query, recipient, sender, message, timestamp, conversationID)
+	})
+}
 
-	if rows == 0 {
-		return fmt.Errorf("message not saved")
-	}
+// Fetch undelivered messages for a user, oldest first
+func GetMessagesForUser(recipient string) ([]Message, error) {
+	query := `SELECT message_id, sender, recipient, message, timestamp FROM messages
+		WHERE recipient = ? AND delivered_at IS NULL AND deleted_at IS NULL
+		ORDER BY message_id ASC`
+	return queryPendingMessages(query, recipient)
+}
 
-	return nil
+// Fetch every message sent to a user after the given message_id, oldest first.
+// Used when a client resumes from the last message it has seen.
+func GetMessagesForUserSince(recipient string, afterID int) ([]Message, error) {
+	query := `SELECT message_id, sender, recipient, message, timestamp FROM messages
+		WHERE recipient = ? AND message_id > ? AND deleted_at IS NULL
+		ORDER BY message_id ASC`
+	return queryPendingMessages(query, recipient, afterID)
 }
 
-// Fetch undelivered messages for a user
-func GetMessagesForUser(recipient string) ([]Message, error) {
-	query := "SELECT message_id, sender, message, timestamp FROM messages WHERE recipient = ?"
-	rows, err := Db.Query(query, recipient)
+func queryPendingMessages(query string, args ...interface{}) ([]Message, error) {
+	rows, err := Db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve messages: %v", err)
 	}
@@ -47,78 +74,77 @@ func GetMessagesForUser(recipient string) ([]Message, error) {
 	var messages []Message
 	for rows.Next() {
 		var msg Message
-		if err := rows.Scan(&msg.MessageID, &msg.Sender, &msg.Message, &msg.Timestamp); err != nil {
+		if err := rows.Scan(&msg.MessageID, &msg.Sender, &msg.Recipient, &msg.Message, &msg.Timestamp); err != nil {
 			return nil, fmt.Errorf("error scanning row: %v", err)
 		}
 		messages = append(messages, msg)
 	}
 
-	return messages, nil
+	return messages, rows.Err()
 }
 
-// Mark messages as delivered (if applicable)
-func MarkMessagesAsDelivered(recipient string) error {
-	query := "DELETE FROM messages WHERE recipient = ?"
-	_, err := Db.Exec(query, recipient) // Remove delivered messages (or update their status if needed)
+// Mark messages sent to recipient as delivered, up to and including upToID
+func MarkMessagesAsDelivered(recipient string, upToID int) error {
+	query := `UPDATE messages SET delivered_at = ?
+		WHERE recipient = ? AND message_id <= ? AND delivered_at IS NULL`
+	_, err := Db.Exec(query, GetCurrentTimestamp(), recipient, upToID)
 	if err != nil {
 		return fmt.Errorf("failed to mark messages as delivered: %v", err)
 	}
 	return nil
 }
 
-func GetCurrentTimestamp() string {
-	return time.Now().Format(time.RFC3339) // Produces "2025-06-18T14:16:56Z"
-
-}
-
-// Get full chat history between two users
-func GetChatHistory(user1, user2 string) ([]Message, error) {
-	fmt.Println("Fetching chat history between:", user1, "and", user2)
-
-	query := `
-		SELECT message_id, sender, recipient, message, timestamp 
-		FROM messages 
-		WHERE (sender = ? AND recipient = ?) OR (sender = ? AND recipient = ?)
-		ORDER BY timestamp ASC
-	`
-
-	rows, err := Db.Query(query, user1, user2, user2, user1)
-	if err != nil {
-		fmt.Println("Error querying chat history:", err)
-		return nil, err
+// Mark specific messages sent to recipient as delivered
+func MarkMessageIDsAsDelivered(recipient string, ids []int) error {
+	if len(ids) == 0 {
+		return nil
 	}
-	defer rows.Close()
-
-	var history []Message
-	for rows.Next() {
-		var msg Message
-		if err := rows.Scan(&msg.MessageID, &msg.Sender, &msg.Recipient, &msg.Message, &msg.Timestamp); err != nil {
-			fmt.Println("Error scanning row:", err)
-			continue
-		}
-		fmt.Printf("Found message: %+v\n", msg)
-		history = append(history, msg)
+	placeholders := make([]string, len(ids))
+	args := []interface{}{GetCurrentTimestamp(), recipient}
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args = append(args, id)
+	}
+	query := `UPDATE messages SET delivered_at = ?
+		WHERE recipient = ? AND delivered_at IS NULL AND message_id IN (` + strings.Join(placeholders, ",") + `)`
+	if _, err := Db.Exec(query, args...); err != nil {
+		return fmt.Errorf("failed to mark messages as delivered: %v", err)
 	}
+	return nil
+}
+
+func GetCurrentTimestamp() string {
+	return time.Now().Format(time.RFC3339) // Produces "2025-06-18T14:16:56Z"
 
-	fmt.Printf("Total messages found: %d\n", len(history))
-	return history, nil
 }
 
-// Get total unread message count for a user
+// countedUnreadFilter leaves out messages m in conversations the recipient
+// muted without keeping them in unread totals. It takes the current time.
+const countedUnreadFilter = `
+		AND NOT EXISTS (
+			SELECT 1 FROM chat_preferences p JOIN users u ON u.uid = p.user_id
+			WHERE u.nickname = m.recipient AND p.kind = 'conversation' AND p.target_id = m.conversation_id
+				AND p.muted_until > ? AND p.count_unread = 0
+		)`
+
+// Get total unread message count for a user. Conversations the user muted
+// without keeping them in unread totals are left out.
 func GetUnreadMessageCount(user string) (int, error) {
-	query := `SELECT COUNT(*) FROM messages WHERE recipient = ? AND is_read = 0`
+	query := `SELECT COUNT(*) FROM messages m WHERE m.recipient = ? AND m.is_read = 0` + countedUnreadFilter
 	var count int
-	err := Db.QueryRow(query, user).Scan(&count)
+	err := Db.QueryRow(query, user, nowUTC()).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
 	return count, nil
 }
 
-// Get unread message count per sender for a user
+// Get unread message count per sender for a user, with the same muted
+// conversations left out as in GetUnreadMessageCount
 func GetUnreadMessageCountBySender(user string) (map[string]int, error) {
-	query := `SELECT sender, COUNT(*) FROM messages WHERE recipient = ? AND is_read = 0 GROUP BY sender`
-	rows, err := Db.Query(query, user)
+	query := `SELECT m.sender, COUNT(*) FROM messages m WHERE m.recipient = ? AND m.is_read = 0` +
+		countedUnreadFilter + ` GROUP BY m.sender`
+	rows, err := Db.Query(query, user, nowUTC())
 	if err != nil {
 		return nil, err
 	}
@@ -136,11 +162,37 @@ func GetUnreadMessageCountBySender(user string) (map[string]int, error) {
 	return counts, nil
 }
 
-// Mark all messages from sender to user as read
-func MarkMessagesAsRead(user, sender string) error {
-	query := `UPDATE messages SET is_read = 1 WHERE recipient = ? AND sender = ? AND is_read = 0`
-	_, err := Db.Exec(query, user, sender)
-	return err
+// Mark messages from sender to user as read, up to and including upToID
+// (0 means all of them). Returns the highest message_id that became read,
+// or 0 if there was nothing unread, and the read time.
+func MarkMessagesAsRead(user, sender string, upToID int) (int, string, error) {
+	tx, err := Db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var lastID sql.NullInt64
+	err = tx.QueryRow(`SELECT MAX(message_id) FROM messages
+		WHERE recipient = ? AND sender = ? AND is_read = 0 AND (? = 0 OR message_id <= ?)`,
+		user, sender, upToID, upToID).Scan(&lastID)
+	if err != nil {
+		return 0, "", err
+	}
+	if !lastID.Valid {
+		return 0, "", nil
+	}
+
+	now := GetCurrentTimestamp()
+	query := `UPDATE messages SET is_read = 1, read_at = ?, delivered_at = COALESCE(delivered_at, ?)
+		WHERE recipient = ? AND sender = ? AND is_read = 0 AND message_id <= ?`
+	if _, err := tx.Exec(query, now, now, user, sender, lastID.Int64); err != nil {
+		return 0, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, "", err
+	}
+	return int(lastID.Int64), now, nil
 }
 
 func IsFollowing(followerNickname, followeeNickname string) (bool, error) {
@@ -171,3 +223,31 @@ func IsPublic(username string) (bool, error) {
 	}
 	return isPublicStr == "public", nil
 }
+
+// HasDirectMessages reports whether a and b have exchanged any direct message
+func HasDirectMessages(a, b string) (bool, error) {
+	var exists bool
+	err := Db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM messages WHERE (sender = ? AND recipient = ?) OR (sender = ? AND recipient = ?))
+	`, a, b, b, a).Scan(&exists)
+	return exists, err
+}
+
+// CanMessage reports whether sender may send a direct message to target,
+// the same policy as CanAccessChatHandler: the target must exist and either
+// be public or be followed by sender with an accepted follow.
+func CanMessage(sender, target string) (bool, error) {
+	var isPublicStr string
+	err := Db.QueryRow("SELECT is_public FROM users WHERE nickname = ?", target).Scan(&isPublicStr)
+	if err == sql.ErrNoRows {
+		return false, ErrUserNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	if sender == target || isPublicStr == "public" {
+		return true, nil
+	}
+
+	return IsFollowing(sender, target)
+}
@@ -26,16 +26,6 @@ func GetUserID(email string) (int, error) {
 	return userid, nil
 }
 
-func GetUserIDBySession(sessionID string) (int, error) {
-	query := `SELECT user_id FROM sessions WHERE session = ?`
-	var userID int
-	err := Db.QueryRow(query, sessionID).Scan(&userID)
-	if err != nil {
-		return -1, fmt.Errorf("could not find user_id for session_id: %v", err)
-	}
-	return userID, nil
-}
-
 func GetNickname(user_id int) (string, error) {
 	query := `SELECT nickname FROM users WHERE uid = ?`
 	var nickname sql.NullString
@@ -0,0 +1,206 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAttachmentNotFound  = errors.New("attachment not found")
+	ErrAttachmentNotUsable = errors.New("attachment not found or already sent")
+)
+
+// Attachment is a file uploaded for a chat message. Until it is sent it
+// belongs to no message and only the uploader can fetch it.
+type Attachment struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+
+	Uploader       string `json:"-"`
+	FileName       string `json:"-"`
+	MessageID      *int   `json:"-"`
+	GroupMessageID *int   `json:"-"`
+}
+
+func attachmentURL(id int) string {
+	return fmt.Sprintf("/chat/attachments/%d", id)
+}
+
+// CreateAttachment records a file saved on disk as fileName
+func CreateAttachment(uploader, fileName, originalName, contentType string, size int64) (*Attachment, error) {
+	result, err := Db.Exec(`
+		INSERT INTO chat_attachments (uploader, file_name, original_name, content_type, size, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, uploader, fileName, originalName, contentType, size, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("error saving attachment: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &Attachment{
+		ID:          int(id),
+		Name:        originalName,
+		ContentType: contentType,
+		Size:        size,
+		URL:         attachmentURL(int(id)),
+		Uploader:    uploader,
+		FileName:    fileName,
+	}, nil
+}
+
+const attachmentColumns = `id, original_name, content_type, size, uploader, file_name, message_id, group_message_id`
+
+func scanAttachment(scan func(...interface{}) error) (Attachment, error) {
+	var a Attachment
+	err := scan(&a.ID, &a.Name, &a.ContentType, &a.Size, &a.Uploader, &a.FileName, &a.MessageID, &a.GroupMessageID)
+	a.URL = attachmentURL(a.ID)
+	return a, err
+}
+
+func GetAttachment(id int) (*Attachment, error) {
+	a, err := scanAttachment(Db.QueryRow("SELECT "+attachmentColumns+" FROM chat_attachments WHERE id = ?", id).Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// CheckAttachments verifies that uploader may send every attachment in ids
+func CheckAttachments(uploader string, ids []int) error {
+	for _, id := range ids {
+		var usable bool
+		err := Db.QueryRow(`
+			SELECT EXISTS(SELECT 1 FROM chat_attachments
+				WHERE id = ? AND uploader = ? AND message_id IS NULL AND group_message_id IS NULL)
+		`, id, uploader).Scan(&usable)
+		if err != nil {
+			return err
+		}
+		if !usable {
+			return ErrAttachmentNotUsable
+		}
+	}
+	return nil
+}
+
+// saveWithAttachments inserts a message and links uploaded attachments to it
+// in one transaction, so a message is never saved without the files it was
+// sent with. column is the attachment column pointing at the new message.
+func saveWithAttachments(column string, ids []int, uploader string, insert func(*sql.Tx) (sql.Result, error)) (int, []Attachment, error) {
+	tx, err := Db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := insert(tx)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to save message: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading message id: %v", err)
+	}
+	messageID := int(id)
+
+	var attachments []Attachment
+	for _, attachmentID := range ids {
+		result, err := tx.Exec(`
+			UPDATE chat_attachments SET `+column+` = ?
+			WHERE id = ? AND uploader = ? AND message_id IS NULL AND group_message_id IS NULL
+		`, messageID, attachmentID, uploader)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error attaching file: %v", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return 0, nil, ErrAttachmentNotUsable
+		}
+		a, err := scanAttachment(tx.QueryRow("SELECT "+attachmentColumns+" FROM chat_attachments WHERE id = ?", attachmentID).Scan)
+		if err != nil {
+			return 0, nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return messageID, attachments, nil
+}
+
+// DeleteUnclaimedAttachments removes attachments uploaded before cutoff that
+// were never sent and returns their stored file names
+func DeleteUnclaimedAttachments(cutoff time.Time) ([]string, error) {
+	rows, err := Db.Query(`
+		DELETE FROM chat_attachments
+		WHERE message_id IS NULL AND group_message_id IS NULL AND created_at < ?
+		RETURNING file_name
+	`, cutoff.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("error deleting unclaimed attachments: %v", err)
+	}
+	defer rows.Close()
+
+	var files []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		files = append(files, name)
+	}
+	return files, rows.Err()
+}
+
+// AttachmentsForMessages returns the attachments of each direct or conversation message
+func AttachmentsForMessages(messageIDs []int) (map[int][]Attachment, error) {
+	return attachmentsFor("message_id", messageIDs)
+}
+
+// AttachmentsForGroupMessages returns the attachments of each group chat message
+func AttachmentsForGroupMessages(groupMessageIDs []int) (map[int][]Attachment, error) {
+	return attachmentsFor("group_message_id", groupMessageIDs)
+}
+
+func attachmentsFor(column string, ids []int) (map[int][]Attachment, error) {
+	result := make(map[int][]Attachment)
+	if len(ids) == 0 {
+		return result, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := Db.Query(`
+		SELECT `+attachmentColumns+` FROM chat_attachments
+		WHERE `+column+` IN (?`+strings.Repeat(", ?", len(ids)-1)+`)
+		ORDER BY id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a, err := scanAttachment(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		owner := a.MessageID
+		if column == "group_message_id" {
+			owner = a.GroupMessageID
+		}
+		result[*owner] = append(result[*owner], a)
+	}
+	return result, rows.Err()
+}
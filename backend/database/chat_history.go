@@ -0,0 +1,183 @@
+package database
+
+// Page sizes for GetChatHistory
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 200
+)
+
+// HistoryQuery selects one page of a conversation by message_id. At most one
+// of Before, After and Around is set; with none the newest messages are
+// returned.
+type HistoryQuery struct {
+	Before int // messages older than this id
+	After  int // messages newer than this id
+	Around int // a page centred on this id, e.g. to jump to a search result
+	Limit  int
+}
+
+// ChatHistory is one page of a conversation in ascending message_id order.
+// NewerCount is how many messages exist after the last one in the page.
+type ChatHistory struct {
+	Messages   []Message `json:"messages"`
+	HasOlder   bool      `json:"has_older"`
+	HasNewer   bool      `json:"has_newer"`
+	NewerCount int       `json:"newer_count"`
+}
+
+const historyColumns = `message_id, sender, recipient, message, timestamp, delivered_at, read_at, edited_at, deleted_at`
+
+// GetChatHistory returns a page of the conversation between user1 and user2.
+// Each direction is read separately so both halves are range scans on
+// idx_messages_conversation (sender, recipient, message_id).
+func GetChatHistory(user1, user2 string, q HistoryQuery) (*ChatHistory, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultHistoryLimit
+	}
+	if q.Limit > MaxHistoryLimit {
+		q.Limit = MaxHistoryLimit
+	}
+
+	var (
+		messages    []Message
+		first, last int // bounds used for has_older / newer_count when the page is empty
+		err         error
+	)
+
+	switch {
+	case q.Around > 0:
+		anchor, err := GetMessageByID(q.Around)
+		if err != nil {
+			return nil, err
+		}
+		if !inConversation(anchor, user1, user2) {
+			return nil, ErrMessageNotFound
+		}
+		older, err := queryConversationPage(user1, user2, "message_id < ?", "DESC", (q.Limit-1)/2, q.Around)
+		if err != nil {
+			return nil, err
+		}
+		newer, err := queryConversationPage(user1, user2, "message_id >= ?", "ASC", q.Limit-len(older), q.Around)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(reverseMessages(older), newer...)
+	case q.After > 0:
+		first, last = q.After+1, q.After
+		messages, err = queryConversationPage(user1, user2, "message_id > ?", "ASC", q.Limit, q.After)
+	case q.Before > 0:
+		first, last = q.Before, q.Before-1
+		messages, err = queryConversationPage(user1, user2, "message_id < ?", "DESC", q.Limit, q.Before)
+		messages = reverseMessages(messages)
+	default:
+		messages, err = queryConversationPage(user1, user2, "1 = 1", "DESC", q.Limit)
+		messages = reverseMessages(messages)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadMessageExtras(messages); err != nil {
+		return nil, err
+	}
+
+	if len(messages) > 0 {
+		first, last = messages[0].MessageID, messages[len(messages)-1].MessageID
+	}
+	history := &ChatHistory{Messages: messages}
+	if history.Messages == nil {
+		history.Messages = []Message{}
+	}
+	if first > 0 {
+		older, err := countConversation(user1, user2, "message_id < ?", first)
+		if err != nil {
+			return nil, err
+		}
+		history.HasOlder = older > 0
+	}
+	history.NewerCount, err = countConversation(user1, user2, "message_id > ?", last)
+	if err != nil {
+		return nil, err
+	}
+	history.HasNewer = history.NewerCount > 0
+	return history, nil
+}
+
+func inConversation(msg *Message, user1, user2 string) bool {
+	return (msg.Sender == user1 && msg.Recipient == user2) || (msg.Sender == user2 && msg.Recipient == user1)
+}
+
+// queryConversationPage returns up to limit messages of the conversation
+// matching cond, in the given message_id order. UNION rather than UNION ALL
+// keeps a conversation with oneself from listing every message twice.
+func queryConversationPage(user1, user2, cond, order string, limit int, args ...interface{}) ([]Message, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	half := `SELECT * FROM (SELECT ` + historyColumns + ` FROM messages
+		WHERE sender = ? AND recipient = ? AND ` + cond + `
+		ORDER BY message_id ` + order + ` LIMIT ?)`
+	query := `SELECT * FROM (` + half + ` UNION ` + half + `) ORDER BY message_id ` + order + ` LIMIT ?`
+
+	params := append([]interface{}{user1, user2}, args...)
+	params = append(params, limit, user2, user1)
+	params = append(params, args...)
+	params = append(params, limit, limit)
+
+	rows, err := Db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.MessageID, &msg.Sender, &msg.Recipient, &msg.Message, &msg.Timestamp,
+			&msg.DeliveredAt, &msg.ReadAt, &msg.EditedAt, &msg.DeletedAt); err != nil {
+			return nil, err
+		}
+		msg.Deleted = msg.DeletedAt != nil
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func countConversation(user1, user2, cond string, arg int) (int, error) {
+	query := `SELECT COUNT(*) FROM messages
+		WHERE ((sender = ? AND recipient = ?) OR (sender = ? AND recipient = ?)) AND ` + cond
+	var count int
+	err := Db.QueryRow(query, user1, user2, user2, user1, arg).Scan(&count)
+	return count, err
+}
+
+func reverseMessages(messages []Message) []Message {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages
+}
+
+// loadMessageExtras fills in the attachments and reactions of messages that
+// are not deleted
+func loadMessageExtras(messages []Message) error {
+	ids := make([]int, 0, len(messages))
+	for _, msg := range messages {
+		if !msg.Deleted {
+			ids = append(ids, msg.MessageID)
+		}
+	}
+	attachments, err := AttachmentsForMessages(ids)
+	if err != nil {
+		return err
+	}
+	reactions, err := ReactionsForMessages(ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Attachments = attachments[messages[i].MessageID]
+		messages[i].Reactions = reactions[messages[i].MessageID]
+	}
+	return nil
+}
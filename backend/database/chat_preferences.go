@@ -0,0 +1,160 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Kinds of chat a preference applies to
+const (
+	ChatKindConversation = "conversation"
+	ChatKindGroup        = "group"
+)
+
+// mutedForever is stored in muted_until for mutes without an end. RFC3339
+// UTC strings sort chronologically, so "muted_until > now" works for both.
+const mutedForever = "9999-12-31T23:59:59Z"
+
+// ChatPreference is one user's mute and archive setting for a conversation
+// or group. MutedUntil is nil when the mute has no end.
+type ChatPreference struct {
+	Kind        string  `json:"kind"`
+	TargetID    int     `json:"target_id"`
+	Muted       bool    `json:"muted"`
+	MutedUntil  *string `json:"muted_until,omitempty"`
+	CountUnread bool    `json:"count_unread"`
+	Archived    bool    `json:"archived"`
+	ArchivedAt  *string `json:"archived_at,omitempty"`
+}
+
+func nowUTC() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+func scanChatPreference(row interface{ Scan(...interface{}) error }) (*ChatPreference, error) {
+	var (
+		p          ChatPreference
+		mutedUntil sql.NullString
+	)
+	if err := row.Scan(&p.Kind, &p.TargetID, &mutedUntil, &p.CountUnread, &p.ArchivedAt); err != nil {
+		return nil, err
+	}
+	if mutedUntil.Valid && mutedUntil.String > nowUTC() {
+		p.Muted = true
+		if mutedUntil.String != mutedForever {
+			p.MutedUntil = &mutedUntil.String
+		}
+	}
+	p.Archived = p.ArchivedAt != nil
+	return &p, nil
+}
+
+const chatPreferenceColumns = `kind, target_id, muted_until, count_unread, archived_at`
+
+// GetChatPreference returns userID's setting for a chat, or the defaults
+// (not muted, not archived) when there is none
+func GetChatPreference(userID int, kind string, targetID int) (*ChatPreference, error) {
+	p, err := scanChatPreference(Db.QueryRow(`
+		SELECT `+chatPreferenceColumns+` FROM chat_preferences
+		WHERE user_id = ? AND kind = ? AND target_id = ?
+	`, userID, kind, targetID))
+	if err == sql.ErrNoRows {
+		return &ChatPreference{Kind: kind, TargetID: targetID, CountUnread: true}, nil
+	}
+	return p, err
+}
+
+// ListChatPreferences returns userID's chats that are currently muted or archived
+func ListChatPreferences(userID int) ([]ChatPreference, error) {
+	rows, err := Db.Query(`
+		SELECT `+chatPreferenceColumns+` FROM chat_preferences
+		WHERE user_id = ? AND (muted_until > ? OR archived_at IS NOT NULL)
+		ORDER BY kind, target_id
+	`, userID, nowUTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefs := []ChatPreference{}
+	for rows.Next() {
+		p, err := scanChatPreference(rows)
+		if err != nil {
+			return nil, err
+		}
+		prefs = append(prefs, *p)
+	}
+	return prefs, rows.Err()
+}
+
+// ChatPreferencesByTarget returns userID's muted or archived chats of one kind keyed by id
+func ChatPreferencesByTarget(userID int, kind string) (map[int]ChatPreference, error) {
+	prefs, err := ListChatPreferences(userID)
+	if err != nil {
+		return nil, err
+	}
+	byTarget := make(map[int]ChatPreference)
+	for _, p := range prefs {
+		if p.Kind == kind {
+			byTarget[p.TargetID] = p
+		}
+	}
+	return byTarget, nil
+}
+
+// MuteChat mutes a chat for userID until the given time, or forever when
+// until is nil. countUnread keeps its messages in the user's unread totals.
+func MuteChat(userID int, kind string, targetID int, until *time.Time, countUnread bool) (*ChatPreference, error) {
+	mutedUntil := mutedForever
+	if until != nil {
+		mutedUntil = until.UTC().Format(time.RFC3339)
+	}
+	if _, err := Db.Exec(`
+		INSERT INTO chat_preferences (user_id, kind, target_id, muted_until, count_unread)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, kind, target_id) DO UPDATE SET
+			muted_until = excluded.muted_until,
+			count_unread = excluded.count_unread
+	`, userID, kind, targetID, mutedUntil, countUnread); err != nil {
+		return nil, err
+	}
+	return GetChatPreference(userID, kind, targetID)
+}
+
+// UnmuteChat ends any mute userID has on a chat
+func UnmuteChat(userID int, kind string, targetID int) (*ChatPreference, error) {
+	if _, err := Db.Exec(`
+		UPDATE chat_preferences SET muted_until = NULL, count_unread = 1
+		WHERE user_id = ? AND kind = ? AND target_id = ?
+	`, userID, kind, targetID); err != nil {
+		return nil, err
+	}
+	return GetChatPreference(userID, kind, targetID)
+}
+
+// SetChatArchived archives or unarchives a chat for userID
+func SetChatArchived(userID int, kind string, targetID int, archived bool) (*ChatPreference, error) {
+	var archivedAt *string
+	if archived {
+		now := nowUTC()
+		archivedAt = &now
+	}
+	if _, err := Db.Exec(`
+		INSERT INTO chat_preferences (user_id, kind, target_id, archived_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id, kind, target_id) DO UPDATE SET archived_at = excluded.archived_at
+	`, userID, kind, targetID, archivedAt); err != nil {
+		return nil, err
+	}
+	return GetChatPreference(userID, kind, targetID)
+}
+
+// IsChatMuted reports whether userID currently has a chat muted
+func IsChatMuted(userID int, kind string, targetID int) (bool, error) {
+	var muted bool
+	err := Db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM chat_preferences
+			WHERE user_id = ? AND kind = ? AND target_id = ? AND muted_until > ?)
+	`, userID, kind, targetID, nowUTC()).Scan(&muted)
+	return muted, err
+}
@@ -0,0 +1,404 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Conversation kinds. A direct conversation always has exactly the two
+// nicknames in direct_a/direct_b as participants and cannot be changed.
+const (
+	ConversationDirect = "direct"
+	ConversationGroup  = "group"
+)
+
+var (
+	ErrConversationNotFound = errors.New("conversation not found")
+	ErrNotParticipant       = errors.New("not a participant of this conversation")
+	ErrDirectConversation   = errors.New("direct conversations cannot be changed")
+)
+
+type Conversation struct {
+	ID               int      `json:"id"`
+	Kind             string   `json:"kind"`
+	Title            *string  `json:"title,omitempty"`
+	CreatedBy        *string  `json:"created_by,omitempty"`
+	CreatedAt        string   `json:"created_at"`
+	Participants     []string `json:"participants"`
+	LastMessageID    *int     `json:"last_message_id,omitempty"`
+	LastMessageAt    *string  `json:"last_message_at,omitempty"`
+	RetentionSeconds int      `json:"retention_seconds,omitempty"` // 0 keeps messages forever
+
+	// Set per viewer by the conversation list
+	Muted    bool `json:"muted,omitempty"`
+	Archived bool `json:"archived,omitempty"`
+}
+
+// ConversationMessage is a message in a conversation of any kind
+type ConversationMessage struct {
+	MessageID      int     `json:"message_id"`
+	ConversationID int     `json:"conversation_id"`
+	Sender         string  `json:"sender"`
+	Message        string  `json:"message"`
+	Timestamp      string  `json:"timestamp"`
+	EditedAt       *string `json:"edited_at,omitempty"`
+	Deleted        bool    `json:"deleted"`
+
+	Attachments []Attachment      `json:"attachments,omitempty"`
+	Reactions   []ReactionSummary `json:"reactions,omitempty"`
+}
+
+func sortedPair(a, b string) (string, string) {
+	if b < a {
+		return b, a
+	}
+	return a, b
+}
+
+// GetOrCreateDirectConversation returns the direct conversation between a and b
+func GetOrCreateDirectConversation(a, b string) (int, error) {
+	first, second := sortedPair(a, b)
+	tx, err := Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		INSERT OR IGNORE INTO conversations (kind, direct_a, direct_b, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, ConversationDirect, first, second, a, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return 0, fmt.Errorf("error creating direct conversation: %v", err)
+	}
+
+	var id int
+	if err := tx.QueryRow("SELECT id FROM conversations WHERE direct_a = ? AND direct_b = ?", first, second).Scan(&id); err != nil {
+		return 0, err
+	}
+	for _, nickname := range []string{first, second} {
+		if _, err := tx.Exec(`
+			INSERT OR IGNORE INTO conversation_participants (conversation_id, nickname) VALUES (?, ?)
+		`, id, nickname); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// CreateConversation starts a multi-party conversation between creator and
+// participants. Every participant must be an existing user.
+func CreateConversation(creator string, title *string, participants []string) (*Conversation, error) {
+	tx, err := Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO conversations (kind, title, created_by, created_at) VALUES (?, ?, ?, ?)
+	`, ConversationGroup, title, creator, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("error creating conversation: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addParticipants(tx, int(id), append([]string{creator}, participants...)); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetConversation(int(id))
+}
+
+// addParticipants adds nicknames to a conversation, bringing back anyone who left
+func addParticipants(tx *sql.Tx, conversationID int, nicknames []string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, nickname := range nicknames {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE nickname = ?)", nickname).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrUserNotFound
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO conversation_participants (conversation_id, nickname, joined_at) VALUES (?, ?, ?)
+			ON CONFLICT(conversation_id, nickname) DO UPDATE SET joined_at = excluded.joined_at, left_at = NULL
+			WHERE left_at IS NOT NULL
+		`, conversationID, nickname, now); err != nil {
+			return fmt.Errorf("error adding participant: %v", err)
+		}
+	}
+	return nil
+}
+
+// GetConversation loads a conversation and its current participants
+func GetConversation(id int) (*Conversation, error) {
+	var c Conversation
+	err := Db.QueryRow(`
+		SELECT id, kind, title, created_by, created_at,
+			(SELECT MAX(message_id) FROM messages WHERE conversation_id = conversations.id),
+			(SELECT timestamp FROM messages WHERE conversation_id = conversations.id ORDER BY message_id DESC LIMIT 1),
+			COALESCE(retention_seconds, 0)
+		FROM conversations WHERE id = ?
+	`, id).Scan(&c.ID, &c.Kind, &c.Title, &c.CreatedBy, &c.CreatedAt, &c.LastMessageID, &c.LastMessageAt, &c.RetentionSeconds)
+	if err == sql.ErrNoRows {
+		return nil, ErrConversationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.Participants, err = GetConversationParticipants(id); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// GetConversationParticipants returns the nicknames that have not left
+func GetConversationParticipants(id int) ([]string, error) {
+	rows, err := Db.Query(`
+		SELECT nickname FROM conversation_participants
+		WHERE conversation_id = ? AND left_at IS NULL
+		ORDER BY joined_at, nickname
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	participants := []string{}
+	for rows.Next() {
+		var nickname string
+		if err := rows.Scan(&nickname); err != nil {
+			return nil, err
+		}
+		participants = append(participants, nickname)
+	}
+	return participants, rows.Err()
+}
+
+// IsConversationParticipant reports whether nickname currently belongs to the conversation
+func IsConversationParticipant(id int, nickname string) (bool, error) {
+	var ok bool
+	err := Db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM conversation_participants
+			WHERE conversation_id = ? AND nickname = ? AND left_at IS NULL)
+	`, id, nickname).Scan(&ok)
+	return ok, err
+}
+
+// ListConversations returns nickname's conversations, most recently active first
+func ListConversations(nickname string) ([]Conversation, error) {
+	rows, err := Db.Query(`
+		SELECT c.id
+		FROM conversations c
+		JOIN conversation_participants p ON p.conversation_id = c.id
+		WHERE p.nickname = ? AND p.left_at IS NULL
+		ORDER BY COALESCE((SELECT MAX(message_id) FROM messages m WHERE m.conversation_id = c.id), 0) DESC, c.id DESC
+	`, nickname)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	conversations := []Conversation{}
+	for _, id := range ids {
+		c, err := GetConversation(id)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, *c)
+	}
+	return conversations, nil
+}
+
+// changeableConversation loads a multi-party conversation that actor belongs to
+func changeableConversation(id int, actor string) (*Conversation, error) {
+	c, err := GetConversation(id)
+	if err != nil {
+		return nil, err
+	}
+	if c.Kind == ConversationDirect {
+		return nil, ErrDirectConversation
+	}
+	for _, p := range c.Participants {
+		if p == actor {
+			return c, nil
+		}
+	}
+	return nil, ErrNotParticipant
+}
+
+// RenameConversation sets or clears the title of a multi-party conversation
+func RenameConversation(id int, actor string, title *string) (*Conversation, error) {
+	if _, err := changeableConversation(id, actor); err != nil {
+		return nil, err
+	}
+	if _, err := Db.Exec("UPDATE conversations SET title = ? WHERE id = ?", title, id); err != nil {
+		return nil, fmt.Errorf("error renaming conversation: %v", err)
+	}
+	return GetConversation(id)
+}
+
+// AddConversationParticipants lets a participant bring others into the conversation
+func AddConversationParticipants(id int, actor string, nicknames []string) (*Conversation, error) {
+	if _, err := changeableConversation(id, actor); err != nil {
+		return nil, err
+	}
+	tx, err := Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := addParticipants(tx, id, nicknames); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetConversation(id)
+}
+
+// LeaveConversation removes nickname from a multi-party conversation. The
+// history stays, and they can be added back later.
+func LeaveConversation(id int, nickname string) (*Conversation, error) {
+	if _, err := changeableConversation(id, nickname); err != nil {
+		return nil, err
+	}
+	if _, err := Db.Exec(`
+		UPDATE conversation_participants SET left_at = ? WHERE conversation_id = ? AND nickname = ?
+	`, time.Now().UTC().Format(time.RFC3339), id, nickname); err != nil {
+		return nil, fmt.Errorf("error leaving conversation: %v", err)
+	}
+	return GetConversation(id)
+}
+
+// SaveConversationMessage stores a message in a multi-party conversation
+// together with the sender's uploaded attachments
+func SaveConversationMessage(conversationID int, sender, message, timestamp string, attachmentIDs []int) (int, []Attachment, error) {
+	return saveWithAttachments("message_id", attachmentIDs, sender, func(tx *sql.Tx) (sql.Result, error) {
+		return tx.Exec(`
+			INSERT INTO messages (conversation_id, sender, recipient, message, timestamp, delivered_at)
+			VALUES (?, ?, '', ?, ?, ?)
+		`, conversationID, sender, message, timestamp, timestamp)
+	})
+}
+
+// ConversationHistory is one page of a conversation, oldest first
+type ConversationHistory struct {
+	Messages   []ConversationMessage `json:"messages"`
+	HasOlder   bool                  `json:"has_older"`
+	HasNewer   bool                  `json:"has_newer"`
+	NewerCount int                   `json:"newer_count"`
+}
+
+// GetConversationHistory pages through a conversation by message_id. Around
+// is not supported here; Before and After work as in GetChatHistory.
+func GetConversationHistory(conversationID int, q HistoryQuery) (*ConversationHistory, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultHistoryLimit
+	}
+	if q.Limit > MaxHistoryLimit {
+		q.Limit = MaxHistoryLimit
+	}
+
+	cond, order, arg := "message_id > ?", "DESC", 0
+	first, last := 0, 0
+	switch {
+	case q.After > 0:
+		cond, order, arg = "message_id > ?", "ASC", q.After
+		first, last = q.After+1, q.After
+	case q.Before > 0:
+		cond, arg = "message_id < ?", q.Before
+		first, last = q.Before, q.Before-1
+	}
+
+	rows, err := Db.Query(`
+		SELECT message_id, conversation_id, sender, message, timestamp, edited_at, deleted_at
+		FROM messages
+		WHERE conversation_id = ? AND `+cond+`
+		ORDER BY message_id `+order+` LIMIT ?
+	`, conversationID, arg, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := &ConversationHistory{Messages: []ConversationMessage{}}
+	for rows.Next() {
+		var (
+			msg       ConversationMessage
+			deletedAt *string
+		)
+		if err := rows.Scan(&msg.MessageID, &msg.ConversationID, &msg.Sender, &msg.Message,
+			&msg.Timestamp, &msg.EditedAt, &deletedAt); err != nil {
+			return nil, err
+		}
+		msg.Deleted = deletedAt != nil
+		history.Messages = append(history.Messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if order == "DESC" {
+		m := history.Messages
+		for i, j := 0, len(m)-1; i < j; i, j = i+1, j-1 {
+			m[i], m[j] = m[j], m[i]
+		}
+	}
+
+	ids := make([]int, 0, len(history.Messages))
+	for _, msg := range history.Messages {
+		if !msg.Deleted {
+			ids = append(ids, msg.MessageID)
+		}
+	}
+	attachments, err := AttachmentsForMessages(ids)
+	if err != nil {
+		return nil, err
+	}
+	reactions, err := ReactionsForMessages(ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range history.Messages {
+		history.Messages[i].Attachments = attachments[history.Messages[i].MessageID]
+		history.Messages[i].Reactions = reactions[history.Messages[i].MessageID]
+	}
+
+	if n := len(history.Messages); n > 0 {
+		first, last = history.Messages[0].MessageID, history.Messages[n-1].MessageID
+	}
+	if first > 0 {
+		err = Db.QueryRow("SELECT EXISTS(SELECT 1 FROM messages WHERE conversation_id = ? AND message_id < ?)",
+			conversationID, first).Scan(&history.HasOlder)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = Db.QueryRow("SELECT COUNT(*) FROM messages WHERE conversation_id = ? AND message_id > ?",
+		conversationID, last).Scan(&history.NewerCount)
+	if err != nil {
+		return nil, err
+	}
+	history.HasNewer = history.NewerCount > 0
+	return history, nil
+}
@@ -0,0 +1,300 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// GroupMessage is one message in a group chat
+type GroupMessage struct {
+	MessageID   int               `json:"message_id"`
+	Sender      string            `json:"sender"`
+	Content     string            `json:"content"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Attachments []Attachment      `json:"attachments,omitempty"`
+	Reactions   []ReactionSummary `json:"reactions,omitempty"`
+}
+
+// GroupHistory is one page of a group chat in ascending id order.
+// LastReadMessageID is the caller's read position, so clients can draw a
+// divider above the first message newer than it.
+type GroupHistory struct {
+	Messages          []GroupMessage `json:"messages"`
+	HasOlder          bool           `json:"has_older"`
+	HasNewer          bool           `json:"has_newer"`
+	NewerCount        int            `json:"newer_count"`
+	LastReadMessageID int            `json:"last_read_message_id"`
+}
+
+// SaveGroupMessage stores a group chat message together with the sender's
+// uploaded attachments
+func SaveGroupMessage(groupID, userID int, sender, message string, createdAt time.Time, attachmentIDs []int) (int, []Attachment, error) {
+	return saveWithAttachments("group_message_id", attachmentIDs, sender, func(tx *sql.Tx) (sql.Result, error) {
+		return tx.Exec("INSERT INTO group_messages (group_id, user_id, message, created_at) VALUES (?, ?, ?, ?)",
+			groupID, userID, message, createdAt)
+	})
+}
+
+// GetGroupHistory returns a page of groupID's chat as seen by userID. Paging
+// works like GetChatHistory, by group message id.
+func GetGroupHistory(groupID, userID int, q HistoryQuery) (*GroupHistory, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultHistoryLimit
+	}
+	if q.Limit > MaxHistoryLimit {
+		q.Limit = MaxHistoryLimit
+	}
+
+	var (
+		messages    []GroupMessage
+		first, last int // bounds used for has_older / newer_count when the page is empty
+		err         error
+	)
+
+	switch {
+	case q.Around > 0:
+		anchorGroup, err := GroupMessageGroup(q.Around)
+		if err != nil {
+			return nil, err
+		}
+		if anchorGroup != groupID {
+			return nil, ErrMessageNotFound
+		}
+		older, err := queryGroupPage(groupID, "gm.id < ?", "DESC", (q.Limit-1)/2, q.Around)
+		if err != nil {
+			return nil, err
+		}
+		newer, err := queryGroupPage(groupID, "gm.id >= ?", "ASC", q.Limit-len(older), q.Around)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(reverseGroupMessages(older), newer...)
+	case q.After > 0:
+		first, last = q.After+1, q.After
+		messages, err = queryGroupPage(groupID, "gm.id > ?", "ASC", q.Limit, q.After)
+	case q.Before > 0:
+		first, last = q.Before, q.Before-1
+		messages, err = queryGroupPage(groupID, "gm.id < ?", "DESC", q.Limit, q.Before)
+		messages = reverseGroupMessages(messages)
+	default:
+		messages, err = queryGroupPage(groupID, "1 = 1", "DESC", q.Limit)
+		messages = reverseGroupMessages(messages)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadGroupMessageExtras(messages); err != nil {
+		return nil, err
+	}
+
+	if len(messages) > 0 {
+		first, last = messages[0].MessageID, messages[len(messages)-1].MessageID
+	}
+	history := &GroupHistory{Messages: messages}
+	if history.Messages == nil {
+		history.Messages = []GroupMessage{}
+	}
+	if first > 0 {
+		older, err := countGroupMessages(groupID, "id < ?", first)
+		if err != nil {
+			return nil, err
+		}
+		history.HasOlder = older > 0
+	}
+	history.NewerCount, err = countGroupMessages(groupID, "id > ?", last)
+	if err != nil {
+		return nil, err
+	}
+	history.HasNewer = history.NewerCount > 0
+
+	history.LastReadMessageID, err = GetGroupLastRead(groupID, userID)
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// queryGroupPage returns up to limit messages of groupID matching cond, in the given id order
+func queryGroupPage(groupID int, cond, order string, limit int, args ...interface{}) ([]GroupMessage, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	params := append([]interface{}{groupID}, args...)
+	params = append(params, limit)
+	rows, err := Db.Query(`
+		SELECT gm.id, users.nickname, gm.message, gm.created_at
+		FROM group_messages gm
+		JOIN users ON gm.user_id = users.uid
+		WHERE gm.group_id = ? AND `+cond+`
+		ORDER BY gm.id `+order+` LIMIT ?
+	`, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []GroupMessage
+	for rows.Next() {
+		var msg GroupMessage
+		if err := rows.Scan(&msg.MessageID, &msg.Sender, &msg.Content, &msg.Timestamp); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func countGroupMessages(groupID int, cond string, arg int) (int, error) {
+	var count int
+	err := Db.QueryRow(`SELECT COUNT(*) FROM group_messages WHERE group_id = ? AND `+cond, groupID, arg).Scan(&count)
+	return count, err
+}
+
+func reverseGroupMessages(messages []GroupMessage) []GroupMessage {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages
+}
+
+// loadGroupMessageExtras fills in the attachments and reactions of group messages
+func loadGroupMessageExtras(messages []GroupMessage) error {
+	ids := make([]int, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.MessageID
+	}
+	attachments, err := AttachmentsForGroupMessages(ids)
+	if err != nil {
+		return err
+	}
+	reactions, err := ReactionsForGroupMessages(ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Attachments = attachments[messages[i].MessageID]
+		messages[i].Reactions = reactions[messages[i].MessageID]
+	}
+	return nil
+}
+
+// GetGroupLastRead returns the id of the last group message userID has read, or 0
+func GetGroupLastRead(groupID, userID int) (int, error) {
+	var lastRead int
+	err := Db.QueryRow(`
+		SELECT COALESCE(last_read_message_id, 0) FROM group_message_notifications
+		WHERE group_id = ? AND user_id = ?
+	`, groupID, userID).Scan(&lastRead)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return lastRead, err
+}
+
+// MarkGroupRead moves userID's read position in groupID up to messageID, or
+// to the newest message when messageID is 0, and recounts what is still
+// unread after it. The position never moves backwards. It returns the
+// resulting last read id and, when the position advanced, the time it did.
+func MarkGroupRead(groupID, userID, messageID int) (int, string, error) {
+	if messageID == 0 {
+		if err := Db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM group_messages WHERE group_id = ?`,
+			groupID).Scan(&messageID); err != nil {
+			return 0, "", err
+		}
+	} else {
+		messageGroup, err := GroupMessageGroup(messageID)
+		if err != nil {
+			return 0, "", err
+		}
+		if messageGroup != groupID {
+			return 0, "", ErrMessageNotFound
+		}
+	}
+
+	tx, err := Db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var previous int
+	err = tx.QueryRow(`SELECT COALESCE(last_read_message_id, 0) FROM group_message_notifications WHERE group_id = ? AND user_id = ?`,
+		groupID, userID).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, "", err
+	}
+
+	lastRead, readAt := previous, ""
+	if messageID > previous {
+		lastRead, readAt = messageID, GetCurrentTimestamp()
+		if _, err := tx.Exec(`
+			INSERT INTO group_message_notifications (group_id, user_id, last_read_message_id, last_read_at, unread_count)
+			VALUES (?, ?, ?, ?, 0)
+			ON CONFLICT(group_id, user_id) DO UPDATE SET
+				last_read_message_id = excluded.last_read_message_id,
+				last_read_at = excluded.last_read_at
+		`, groupID, userID, lastRead, readAt); err != nil {
+			return 0, "", err
+		}
+	}
+	if _, err := tx.Exec(`
+		UPDATE group_message_notifications SET unread_count = (
+			SELECT COUNT(*) FROM group_messages WHERE group_id = ? AND id > ? AND user_id != ?
+		) WHERE group_id = ? AND user_id = ?
+	`, groupID, lastRead, userID, groupID, userID); err != nil {
+		return 0, "", err
+	}
+	return lastRead, readAt, tx.Commit()
+}
+
+// GroupReader is a member who has read a group message
+type GroupReader struct {
+	Nickname string `json:"nickname"`
+	ReadAt   string `json:"read_at,omitempty"`
+}
+
+// GroupMessageSeenBy lists the current members of groupID, other than its
+// sender, whose read position has reached messageID, earliest reader first.
+// Members who turned read receipts off are left out. It also returns how
+// many members besides the sender could have seen it.
+func GroupMessageSeenBy(groupID, messageID int) ([]GroupReader, int, error) {
+	var senderID int
+	err := Db.QueryRow(`SELECT user_id FROM group_messages WHERE id = ? AND group_id = ?`,
+		messageID, groupID).Scan(&senderID)
+	if err == sql.ErrNoRows {
+		return nil, 0, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var audience int
+	if err := Db.QueryRow(`SELECT COUNT(*) FROM group_members WHERE group_id = ? AND user_id != ?`,
+		groupID, senderID).Scan(&audience); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := Db.Query(`
+		SELECT u.nickname, COALESCE(gn.last_read_at, '')
+		FROM group_message_notifications gn
+		JOIN group_members gm ON gm.group_id = gn.group_id AND gm.user_id = gn.user_id
+		JOIN users u ON u.uid = gn.user_id
+		WHERE gn.group_id = ? AND gn.user_id != ? AND gn.last_read_message_id >= ? AND u.read_receipts = 1
+		ORDER BY gn.last_read_at IS NULL, gn.last_read_at, u.nickname
+	`, groupID, senderID, messageID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	readers := []GroupReader{}
+	for rows.Next() {
+		var reader GroupReader
+		if err := rows.Scan(&reader.Nickname, &reader.ReadAt); err != nil {
+			return nil, 0, err
+		}
+		readers = append(readers, reader)
+	}
+	return readers, audience, rows.Err()
+}
@@ -0,0 +1,175 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrMessageNotFound    = errors.New("message not found")
+	ErrNotMessageSender   = errors.New("only the sender can change this message")
+	ErrEditWindowExpired  = errors.New("message can no longer be changed")
+	ErrMessageAlreadyGone = errors.New("message was deleted")
+)
+
+// MessageEdit is one earlier version of an edited direct message
+type MessageEdit struct {
+	PreviousMessage string `json:"previous_message"`
+	EditedAt        string `json:"edited_at"`
+}
+
+// GetMessageByID loads a single direct message, including deleted ones
+func GetMessageByID(messageID int) (*Message, error) {
+	var msg Message
+	err := Db.QueryRow(`
+		SELECT message_id, sender, recipient, message, timestamp, delivered_at, read_at, edited_at, deleted_at, conversation_id
+		FROM messages WHERE message_id = ?
+	`, messageID).Scan(&msg.MessageID, &msg.Sender, &msg.Recipient, &msg.Message, &msg.Timestamp,
+		&msg.DeliveredAt, &msg.ReadAt, &msg.EditedAt, &msg.DeletedAt, &msg.ConversationID)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg.Deleted = msg.DeletedAt != nil
+	return &msg, nil
+}
+
+// checkChangeable enforces that only the sender may change a message, and
+// only within window of sending it
+func checkChangeable(msg *Message, sender string, window time.Duration) error {
+	if msg.Sender != sender {
+		return ErrNotMessageSender
+	}
+	if msg.Deleted {
+		return ErrMessageAlreadyGone
+	}
+	sentAt, err := time.Parse(time.RFC3339, msg.Timestamp)
+	if err != nil || time.Since(sentAt) > window {
+		return ErrEditWindowExpired
+	}
+	return nil
+}
+
+// EditMessage replaces the text of a direct message and keeps the previous
+// text in message_edits
+func EditMessage(messageID int, sender, newText string, window time.Duration) (*Message, error) {
+	msg, err := GetMessageByID(messageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkChangeable(msg, sender, window); err != nil {
+		return nil, err
+	}
+
+	tx, err := Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Both statements repeat the sender and tombstone checks, so an edit that
+	// races with a delete can't write text back into the deleted message
+	now := GetCurrentTimestamp()
+	result, err := tx.Exec(`
+		INSERT INTO message_edits (message_id, previous_message, edited_at)
+		SELECT message_id, message, ? FROM messages
+		WHERE message_id = ? AND sender = ? AND deleted_at IS NULL
+	`, now, messageID, sender)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save edit history: %v", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, ErrMessageAlreadyGone
+	}
+	result, err = tx.Exec(`UPDATE messages SET message = ?, edited_at = ? WHERE message_id = ? AND sender = ? AND deleted_at IS NULL`,
+		newText, now, messageID, sender)
+	if err != nil {
+		return nil, fmt.Errorf("failed to edit message: %v", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, ErrMessageAlreadyGone
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	msg.Message = newText
+	msg.EditedAt = &now
+	return msg, nil
+}
+
+// DeleteMessage unsends a direct message. The row stays as a tombstone so
+// conversation history keeps its shape, but its text, edit history, reactions
+// and attachments are removed. The stored names of the attachment files,
+// which the caller should delete, are returned.
+func DeleteMessage(messageID int, sender string, window time.Duration) (*Message, []string, error) {
+	msg, err := GetMessageByID(messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkChangeable(msg, sender, window); err != nil {
+		return nil, nil, err
+	}
+
+	tx, err := Db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	// Tombstone first: it takes the write lock and fails if a concurrent
+	// delete already did
+	now := GetCurrentTimestamp()
+	result, err := tx.Exec(`UPDATE messages SET message = '', deleted_at = ? WHERE message_id = ? AND sender = ? AND deleted_at IS NULL`,
+		now, messageID, sender)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to delete message: %v", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, nil, ErrMessageAlreadyGone
+	}
+	if _, err := tx.Exec(`DELETE FROM message_edits WHERE message_id = ?`, messageID); err != nil {
+		return nil, nil, fmt.Errorf("failed to clear edit history: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM message_reactions WHERE message_id = ?`, messageID); err != nil {
+		return nil, nil, fmt.Errorf("failed to clear reactions: %v", err)
+	}
+	files, err := deleteAttachmentRows(tx, "message_id", "(?)", []interface{}{messageID})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	msg.Message = ""
+	msg.DeletedAt = &now
+	msg.Deleted = true
+	return msg, files, nil
+}
+
+// GetMessageEdits returns the earlier versions of a message, oldest first
+func GetMessageEdits(messageID int) ([]MessageEdit, error) {
+	rows, err := Db.Query(`
+		SELECT previous_message, edited_at FROM message_edits
+		WHERE message_id = ? ORDER BY id ASC
+	`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := []MessageEdit{}
+	for rows.Next() {
+		var edit MessageEdit
+		if err := rows.Scan(&edit.PreviousMessage, &edit.EditedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+	return edits, rows.Err()
+}
@@ -0,0 +1,239 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Presence states stored in online_status.state
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// Presence is what other users may see of someone's online state. LastSeen
+// is left out when the user hides it in their privacy settings.
+type Presence struct {
+	Nickname string  `json:"nickname"`
+	State    string  `json:"state"`
+	LastSeen *string `json:"last_seen,omitempty"`
+}
+
+// SetPresence records nickname's state and refreshes last_seen
+func SetPresence(nickname, state string) error {
+	_, err := Db.Exec(`
+		INSERT INTO online_status (nickname, is_online, state, last_seen)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(nickname) DO UPDATE SET
+			is_online = excluded.is_online,
+			state = excluded.state,
+			last_seen = excluded.last_seen
+	`, nickname, state != PresenceOffline, state, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// TouchLastSeen moves last_seen forward without changing the state
+func TouchLastSeen(nickname string) error {
+	_, err := Db.Exec("UPDATE online_status SET last_seen = ? WHERE nickname = ?",
+		time.Now().UTC().Format(time.RFC3339), nickname)
+	return err
+}
+
+// ResetPresence marks offline everyone without a live connection on any
+// instance. Called at startup, when no socket from this instance's previous
+// run can still be open.
+func ResetPresence(staleBefore time.Time) error {
+	_, err := Db.Exec(`
+		UPDATE online_status SET is_online = 0, state = ?
+		WHERE state != ? AND nickname NOT IN (SELECT nickname FROM live_connections WHERE seen_at >= ?)
+	`, PresenceOffline, PresenceOffline, staleBefore.UTC().Format(time.RFC3339))
+	return err
+}
+
+// AddLiveConnection counts a new connection of nickname on instanceID and
+// reports whether it is the user's only live connection on any instance
+func AddLiveConnection(instanceID, nickname string, staleBefore time.Time) (bool, error) {
+	tx, err := Db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		INSERT INTO live_connections (instance_id, nickname, connections, seen_at) VALUES (?, ?, 1, ?)
+		ON CONFLICT(instance_id, nickname) DO UPDATE SET
+			connections = connections + 1,
+			seen_at = excluded.seen_at
+	`, instanceID, nickname, nowUTC()); err != nil {
+		return false, err
+	}
+	total, err := countLiveConnections(tx, nickname, staleBefore)
+	if err != nil {
+		return false, err
+	}
+	return total == 1, tx.Commit()
+}
+
+// RemoveLiveConnection counts a closed connection of nickname on instanceID
+// and reports whether the user has no live connection left on any instance
+func RemoveLiveConnection(instanceID, nickname string, staleBefore time.Time) (bool, error) {
+	tx, err := Db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE live_connections SET connections = connections - 1 WHERE instance_id = ? AND nickname = ?",
+		instanceID, nickname); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM live_connections WHERE instance_id = ? AND nickname = ? AND connections <= 0",
+		instanceID, nickname); err != nil {
+		return false, err
+	}
+	total, err := countLiveConnections(tx, nickname, staleBefore)
+	if err != nil {
+		return false, err
+	}
+	return total == 0, tx.Commit()
+}
+
+func countLiveConnections(tx *sql.Tx, nickname string, staleBefore time.Time) (int, error) {
+	var total int
+	err := tx.QueryRow("SELECT COALESCE(SUM(connections), 0) FROM live_connections WHERE nickname = ? AND seen_at >= ?",
+		nickname, staleBefore.UTC().Format(time.RFC3339)).Scan(&total)
+	return total, err
+}
+
+// RefreshLiveConnections marks instanceID's connection counts as current
+func RefreshLiveConnections(instanceID string) error {
+	_, err := Db.Exec("UPDATE live_connections SET seen_at = ? WHERE instance_id = ?", nowUTC(), instanceID)
+	return err
+}
+
+// PruneLiveConnections deletes the counts of instances that stopped
+// refreshing them and returns the users left without a live connection
+func PruneLiveConnections(staleBefore time.Time) ([]string, error) {
+	tx, err := Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("DELETE FROM live_connections WHERE seen_at < ? RETURNING nickname",
+		staleBefore.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	pruned := make(map[string]bool)
+	for rows.Next() {
+		var nickname string
+		if err := rows.Scan(&nickname); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		pruned[nickname] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var gone []string
+	for nickname := range pruned {
+		total, err := countLiveConnections(tx, nickname, staleBefore)
+		if err != nil {
+			return nil, err
+		}
+		if total == 0 {
+			gone = append(gone, nickname)
+		}
+	}
+	return gone, tx.Commit()
+}
+
+// GetPresence returns nickname's presence as others see it
+func GetPresence(nickname string) (*Presence, error) {
+	var (
+		showLastSeen bool
+		state        sql.NullString
+		lastSeen     *string
+	)
+	err := Db.QueryRow(`
+		SELECT u.show_last_seen, o.state, o.last_seen
+		FROM users u
+		LEFT JOIN online_status o ON o.nickname = u.nickname
+		WHERE u.nickname = ?
+	`, nickname).Scan(&showLastSeen, &state, &lastSeen)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Presence{Nickname: nickname, State: PresenceOffline}
+	if state.Valid {
+		p.State = state.String
+	}
+	if showLastSeen {
+		p.LastSeen = lastSeen
+	}
+	return p, nil
+}
+
+// CanSeePresence reports whether viewer may look up target's presence, i.e.
+// whether viewer is in target's GetPresenceAudience: an accepted follower of
+// target or someone target has exchanged messages with
+func CanSeePresence(viewer, target string) (bool, error) {
+	if viewer == target {
+		return true, nil
+	}
+	var allowed bool
+	err := Db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM follows f
+			JOIN users u ON u.uid = f.follower_id
+			JOIN users me ON me.uid = f.following_id
+			WHERE me.nickname = ? AND u.nickname = ? AND f.status = 'accepted'
+		) OR EXISTS (
+			SELECT 1 FROM messages
+			WHERE (sender = ? AND recipient = ?) OR (sender = ? AND recipient = ?)
+		)
+	`, target, viewer, target, viewer, viewer, target).Scan(&allowed)
+	return allowed, err
+}
+
+// GetPresenceAudience returns the users who receive nickname's presence
+// changes: accepted followers and anyone nickname has exchanged messages with
+func GetPresenceAudience(nickname string) ([]string, error) {
+	rows, err := Db.Query(`
+		SELECT u.nickname
+		FROM follows f
+		JOIN users u ON u.uid = f.follower_id
+		JOIN users me ON me.uid = f.following_id
+		WHERE me.nickname = ? AND f.status = 'accepted'
+		UNION
+		SELECT recipient FROM messages WHERE sender = ? AND recipient != ''
+		UNION
+		SELECT sender FROM messages WHERE recipient = ?
+	`, nickname, nickname, nickname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var audience []string
+	for rows.Next() {
+		var other string
+		if err := rows.Scan(&other); err != nil {
+			return nil, err
+		}
+		if other != nickname {
+			audience = append(audience, other)
+		}
+	}
+	return audience, rows.Err()
+}
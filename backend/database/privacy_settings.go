@@ -0,0 +1,37 @@
+package database
+
+import (
+	"fmt"
+	"socialhub/models"
+)
+
+func GetPrivacySettings(userID int) (models.PrivacySettings, error) {
+	var settings models.PrivacySettings
+	err := Db.QueryRow("SELECT read_receipts, show_last_seen FROM users WHERE uid = ?", userID).
+		Scan(&settings.ReadReceipts, &settings.ShowLastSeen)
+	if err != nil {
+		return settings, fmt.Errorf("error loading privacy settings: %v", err)
+	}
+	return settings, nil
+}
+
+func UpdatePrivacySettings(userID int, req models.UpdatePrivacySettingsRequest) error {
+	if req.ReadReceipts != nil {
+		if _, err := Db.Exec("UPDATE users SET read_receipts = ? WHERE uid = ?", *req.ReadReceipts, userID); err != nil {
+			return fmt.Errorf("error updating privacy settings: %v", err)
+		}
+	}
+	if req.ShowLastSeen != nil {
+		if _, err := Db.Exec("UPDATE users SET show_last_seen = ? WHERE uid = ?", *req.ShowLastSeen, userID); err != nil {
+			return fmt.Errorf("error updating privacy settings: %v", err)
+		}
+	}
+	return nil
+}
+
+// ReadReceiptsEnabled reports whether nickname lets senders see when they read a message
+func ReadReceiptsEnabled(nickname string) (bool, error) {
+	var enabled bool
+	err := Db.QueryRow("SELECT read_receipts FROM users WHERE nickname = ?", nickname).Scan(&enabled)
+	return enabled, err
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ReactionSummary aggregates one emoji on one message
+type ReactionSummary struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"`
+}
+
+// reactionTable returns the table and message column for direct/conversation
+// messages or, with group set, group chat messages
+func reactionTable(group bool) (string, string) {
+	if group {
+		return "group_message_reactions", "group_message_id"
+	}
+	return "message_reactions", "message_id"
+}
+
+// AddReaction records nickname's emoji on a message and reports whether it is new
+func AddReaction(group bool, messageID int, nickname, emoji string) (bool, error) {
+	table, column := reactionTable(group)
+	result, err := Db.Exec(`
+		INSERT OR IGNORE INTO `+table+` (`+column+`, nickname, emoji, created_at) VALUES (?, ?, ?, ?)
+	`, messageID, nickname, emoji, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return false, fmt.Errorf("error adding reaction: %v", err)
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// RemoveReaction deletes nickname's emoji from a message and reports whether it existed
+func RemoveReaction(group bool, messageID int, nickname, emoji string) (bool, error) {
+	table, column := reactionTable(group)
+	result, err := Db.Exec(`
+		DELETE FROM `+table+` WHERE `+column+` = ? AND nickname = ? AND emoji = ?
+	`, messageID, nickname, emoji)
+	if err != nil {
+		return false, fmt.Errorf("error removing reaction: %v", err)
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ReactionsForMessages aggregates the reactions on direct or conversation messages
+func ReactionsForMessages(messageIDs []int) (map[int][]ReactionSummary, error) {
+	return reactionsFor(false, messageIDs)
+}
+
+// ReactionsForGroupMessages aggregates the reactions on group chat messages
+func ReactionsForGroupMessages(groupMessageIDs []int) (map[int][]ReactionSummary, error) {
+	return reactionsFor(true, groupMessageIDs)
+}
+
+// reactionsFor groups reactions by message and emoji, in the order each emoji
+// was first used
+func reactionsFor(group bool, ids []int) (map[int][]ReactionSummary, error) {
+	result := make(map[int][]ReactionSummary)
+	if len(ids) == 0 {
+		return result, nil
+	}
+	table, column := reactionTable(group)
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := Db.Query(`
+		SELECT `+column+`, emoji, nickname FROM `+table+`
+		WHERE `+column+` IN (?`+strings.Repeat(", ?", len(ids)-1)+`)
+		ORDER BY created_at, rowid
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			messageID       int
+			emoji, nickname string
+		)
+		if err := rows.Scan(&messageID, &emoji, &nickname); err != nil {
+			return nil, err
+		}
+		summaries := result[messageID]
+		found := false
+		for i := range summaries {
+			if summaries[i].Emoji == emoji {
+				summaries[i].Count++
+				summaries[i].Users = append(summaries[i].Users, nickname)
+				found = true
+				break
+			}
+		}
+		if !found {
+			summaries = append(summaries, ReactionSummary{Emoji: emoji, Count: 1, Users: []string{nickname}})
+		}
+		result[messageID] = summaries
+	}
+	return result, rows.Err()
+}
+
+// GroupMessageGroup returns the group a group chat message was sent to
+func GroupMessageGroup(groupMessageID int) (int, error) {
+	var groupID int
+	err := Db.QueryRow(`SELECT group_id FROM group_messages WHERE id = ?`, groupMessageID).Scan(&groupID)
+	if err == sql.ErrNoRows {
+		return 0, ErrMessageNotFound
+	}
+	return groupID, err
+}
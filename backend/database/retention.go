@@ -0,0 +1,264 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Bounds for a chat's retention period
+const (
+	MinRetention = time.Minute
+	MaxRetention = 365 * 24 * time.Hour
+)
+
+// expireBatchSize caps how many messages of one chat a single sweep removes
+const expireBatchSize = 500
+
+var ErrGroupNotFound = errors.New("group not found")
+
+// RetentionPolicy is how long a conversation or group keeps its messages.
+// RetentionSeconds is 0 when messages are kept forever.
+type RetentionPolicy struct {
+	Kind             string  `json:"kind"`
+	TargetID         int     `json:"target_id"`
+	RetentionSeconds int     `json:"retention_seconds"`
+	UpdatedBy        *string `json:"updated_by,omitempty"`
+	UpdatedAt        *string `json:"updated_at,omitempty"`
+}
+
+// retentionTable returns the table and id column holding kind's policy
+func retentionTable(kind string) (string, string) {
+	if kind == ChatKindGroup {
+		return "groups", "group_id"
+	}
+	return "conversations", "id"
+}
+
+// GetRetentionPolicy loads the retention policy of a conversation or group
+func GetRetentionPolicy(kind string, targetID int) (*RetentionPolicy, error) {
+	table, column := retentionTable(kind)
+	p := RetentionPolicy{Kind: kind, TargetID: targetID}
+	var seconds sql.NullInt64
+	err := Db.QueryRow(`
+		SELECT retention_seconds, retention_updated_by, retention_updated_at FROM `+table+` WHERE `+column+` = ?
+	`, targetID).Scan(&seconds, &p.UpdatedBy, &p.UpdatedAt)
+	if err == sql.ErrNoRows {
+		if kind == ChatKindGroup {
+			return nil, ErrGroupNotFound
+		}
+		return nil, ErrConversationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.RetentionSeconds = int(seconds.Int64)
+	return &p, nil
+}
+
+// SetRetentionPolicy changes how long a conversation or group keeps its
+// messages; 0 turns disappearing messages off
+func SetRetentionPolicy(kind string, targetID int, retention time.Duration, actor string) (*RetentionPolicy, error) {
+	var seconds interface{}
+	if retention > 0 {
+		seconds = int(retention / time.Second)
+	}
+	table, column := retentionTable(kind)
+	if _, err := Db.Exec(`
+		UPDATE `+table+` SET retention_seconds = ?, retention_updated_by = ?, retention_updated_at = ? WHERE `+column+` = ?
+	`, seconds, actor, nowUTC(), targetID); err != nil {
+		return nil, fmt.Errorf("error setting retention policy: %v", err)
+	}
+	return GetRetentionPolicy(kind, targetID)
+}
+
+// ExpiredMessages lists what one sweep removed from a chat. Files are the
+// stored names of attachments whose files should now be deleted.
+type ExpiredMessages struct {
+	Kind       string
+	TargetID   int
+	MessageIDs []int
+	Files      []string
+}
+
+// ExpireMessages deletes messages that have outlived their chat's retention
+// policy, together with their edits, reactions and attachments
+func ExpireMessages(now time.Time) ([]ExpiredMessages, error) {
+	var expired []ExpiredMessages
+
+	conversations, err := retentionTargets("conversations", "id")
+	if err != nil {
+		return nil, err
+	}
+	for id, seconds := range conversations {
+		batch, err := expireConversation(id, now.Add(-time.Duration(seconds)*time.Second))
+		if err != nil {
+			return expired, err
+		}
+		if batch != nil {
+			expired = append(expired, *batch)
+		}
+	}
+
+	groups, err := retentionTargets("groups", "group_id")
+	if err != nil {
+		return expired, err
+	}
+	for id, seconds := range groups {
+		batch, err := expireGroup(id, now.Add(-time.Duration(seconds)*time.Second))
+		if err != nil {
+			return expired, err
+		}
+		if batch != nil {
+			expired = append(expired, *batch)
+		}
+	}
+	return expired, nil
+}
+
+func retentionTargets(table, column string) (map[int]int, error) {
+	rows, err := Db.Query(`SELECT ` + column + `, retention_seconds FROM ` + table + ` WHERE retention_seconds > 0`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := make(map[int]int)
+	for rows.Next() {
+		var id, seconds int
+		if err := rows.Scan(&id, &seconds); err != nil {
+			return nil, err
+		}
+		targets[id] = seconds
+	}
+	return targets, rows.Err()
+}
+
+// expireConversation removes a conversation's messages sent before cutoff.
+// Timestamps carry mixed UTC offsets, so they are compared with julianday.
+func expireConversation(conversationID int, cutoff time.Time) (*ExpiredMessages, error) {
+	ids, err := queryIDs(`
+		SELECT message_id FROM messages
+		WHERE conversation_id = ? AND julianday(timestamp) < julianday(?)
+		ORDER BY message_id LIMIT ?
+	`, conversationID, cutoff.UTC().Format(time.RFC3339), expireBatchSize)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	tx, err := Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	in, args := inClause(ids)
+	files, err := deleteAttachmentRows(tx, "message_id", in, args)
+	if err != nil {
+		return nil, err
+	}
+	for _, query := range []string{
+		`DELETE FROM message_edits WHERE message_id IN ` + in,
+		`DELETE FROM message_reactions WHERE message_id IN ` + in,
+		`DELETE FROM messages WHERE message_id IN ` + in,
+	} {
+		if _, err := tx.Exec(query, args...); err != nil {
+			return nil, fmt.Errorf("error expiring messages: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &ExpiredMessages{Kind: ChatKindConversation, TargetID: conversationID, MessageIDs: ids, Files: files}, nil
+}
+
+// expireGroup removes a group's chat messages sent before cutoff
+func expireGroup(groupID int, cutoff time.Time) (*ExpiredMessages, error) {
+	ids, err := queryIDs(`
+		SELECT id FROM group_messages
+		WHERE group_id = ? AND julianday(created_at) < julianday(?)
+		ORDER BY id LIMIT ?
+	`, groupID, cutoff.UTC().Format(time.RFC3339), expireBatchSize)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	tx, err := Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	in, args := inClause(ids)
+	files, err := deleteAttachmentRows(tx, "group_message_id", in, args)
+	if err != nil {
+		return nil, err
+	}
+	for _, query := range []string{
+		`DELETE FROM group_message_reactions WHERE group_message_id IN ` + in,
+		`DELETE FROM group_messages WHERE id IN ` + in,
+	} {
+		if _, err := tx.Exec(query, args...); err != nil {
+			return nil, fmt.Errorf("error expiring group messages: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &ExpiredMessages{Kind: ChatKindGroup, TargetID: groupID, MessageIDs: ids, Files: files}, nil
+}
+
+// deleteAttachmentRows removes the attachment rows owned by the given
+// messages and returns their stored file names
+func deleteAttachmentRows(tx *sql.Tx, column, in string, args []interface{}) ([]string, error) {
+	rows, err := tx.Query(`SELECT file_name FROM chat_attachments WHERE `+column+` IN `+in, args...)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		files = append(files, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM chat_attachments WHERE `+column+` IN `+in, args...); err != nil {
+		return nil, fmt.Errorf("error deleting attachments: %v", err)
+	}
+	return files, nil
+}
+
+func queryIDs(query string, args ...interface{}) ([]int, error) {
+	rows, err := Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// inClause builds "(?, ?, ...)" and its arguments for ids
+func inClause(ids []int) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return "(?" + strings.Repeat(", ?", len(ids)-1) + ")", args
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"socialhub/database"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// attachmentDir is kept apart from uploadDir, which /uploads/ serves publicly
+	attachmentDir            = "attachments"
+	maxAttachmentSize        = 50 * 1024 * 1024 // largest allowed type, see attachmentTypes
+	maxAttachmentsPerMessage = 10
+)
+
+// ErrCodeAttachmentInvalid is sent when a frame references an attachment the
+// sender can't use
+const ErrCodeAttachmentInvalid = "attachment_invalid"
+
+// attachmentType is an accepted file type, detected from the file content
+type attachmentType struct {
+	ext     string
+	maxSize int64
+}
+
+var attachmentTypes = map[string]attachmentType{
+	"image/jpeg":      {".jpg", 10 * 1024 * 1024},
+	"image/png":       {".png", 10 * 1024 * 1024},
+	"image/gif":       {".gif", 10 * 1024 * 1024},
+	"image/webp":      {".webp", 10 * 1024 * 1024},
+	"application/pdf": {".pdf", 20 * 1024 * 1024},
+	"video/mp4":       {".mp4", 50 * 1024 * 1024},
+	"video/webm":      {".webm", 50 * 1024 * 1024},
+}
+
+// CreateAttachmentDir makes sure the directory chat attachments are stored in exists
+func CreateAttachmentDir() error {
+	return os.MkdirAll(attachmentDir, 0755)
+}
+
+// UploadChatAttachmentHandler - POST /chat/attachments (multipart field "file")
+// stores a file to send with a chat message and returns its id
+func UploadChatAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nickname, ok := sessionNickname(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1024*1024)
+	if err := r.ParseMultipartForm(10 * 1024 * 1024); err != nil {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Error retrieving file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	// Trust the content, not the client's file name or Content-Type
+	sniff := make([]byte, 512)
+	n, _ := io.ReadFull(file, sniff)
+	contentType := strings.Split(http.DetectContentType(sniff[:n]), ";")[0]
+	kind, allowed := attachmentTypes[contentType]
+	if !allowed {
+		http.Error(w, "Unsupported file type. Send an image, PDF or MP4/WebM video", http.StatusUnsupportedMediaType)
+		return
+	}
+	if header.Size > kind.maxSize {
+		http.Error(w, fmt.Sprintf("File too large, the limit for %s is %d MB", contentType, kind.maxSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+
+	fileName := uuid.New().String() + kind.ext
+	dst, err := os.Create(filepath.Join(attachmentDir, fileName))
+	if err != nil {
+		http.Error(w, "Error creating file", http.StatusInternalServerError)
+		return
+	}
+	size, err := io.Copy(dst, file)
+	dst.Close()
+	if err != nil {
+		os.Remove(filepath.Join(attachmentDir, fileName))
+		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		return
+	}
+
+	attachment, err := database.CreateAttachment(nickname, fileName, filepath.Base(header.Filename), contentType, size)
+	if err != nil {
+		log.Println("Error saving attachment:", err)
+		os.Remove(filepath.Join(attachmentDir, fileName))
+		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachment)
+}
+
+// ServeChatAttachmentHandler - GET /chat/attachments/{id} serves an attachment
+// to the people who can see the message it was sent in
+func ServeChatAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := getUserIDFromContext(r.Context())
+	nickname, ok := sessionNickname(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/chat/attachments/"))
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	attachment, err := database.GetAttachment(id)
+	if err == nil {
+		ok, err = canAccessAttachment(attachment, userID, nickname)
+	}
+	if err != nil && err != database.ErrAttachmentNotFound {
+		log.Printf("Failed to check access to attachment %d: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err != nil || !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(attachmentDir, attachment.FileName))
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", attachment.Name))
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// canAccessAttachment lets the uploader see an unsent attachment, and once
+// sent, everyone who can see the message
+func canAccessAttachment(a *database.Attachment, userID int, nickname string) (bool, error) {
+	switch {
+	case a.MessageID != nil:
+		msg, err := database.GetMessageByID(*a.MessageID)
+		if err == database.ErrMessageNotFound {
+			return false, nil
+		}
+		if err != nil || msg.Deleted {
+			return false, err
+		}
+		return canSeeMessage(msg, nickname)
+	case a.GroupMessageID != nil:
+		var member bool
+		err := database.Db.QueryRow(`
+			SELECT EXISTS(SELECT 1 FROM group_messages gm
+				JOIN group_members m ON m.group_id = gm.group_id
+				WHERE gm.id = ? AND m.user_id = ?)
+		`, *a.GroupMessageID, userID).Scan(&member)
+		return member, err
+	default:
+		return a.Uploader == nickname, nil
+	}
+}
+
+// checkFrameAttachments validates the attachments referenced by a chat frame
+// and answers with an error frame when they can't be sent
+func checkFrameAttachments(conn *Connection, frame InboundFrame, ids []int, to string) bool {
+	if len(ids) > maxAttachmentsPerMessage {
+		sendError(conn, frame, ErrCodeAttachmentInvalid,
+			fmt.Sprintf("At most %d attachments per message", maxAttachmentsPerMessage), to)
+		return false
+	}
+	if err := database.CheckAttachments(conn.nickname, ids); err != nil {
+		if err != database.ErrAttachmentNotUsable {
+			log.Printf("Failed to check attachments for %s: %v", conn.nickname, err)
+			sendError(conn, frame, ErrCodeInternal, "Could not check attachments", to)
+			return false
+		}
+		sendError(conn, frame, ErrCodeAttachmentInvalid, err.Error(), to)
+		return false
+	}
+	return true
+}
+
+// removeAttachmentFiles deletes stored attachment files whose rows are gone
+func removeAttachmentFiles(names []string) {
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(attachmentDir, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove attachment %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"socialhub/pubsub"
+
+	"github.com/google/uuid"
+)
+
+// busChannel is the pub/sub channel every instance publishes frames on
+const busChannel = "socialhub.ws"
+
+// Route kinds carried in busFrame.Kind
+const (
+	routeUser   = "user"
+	routeUserID = "user_id"
+	routeGroup  = "group"
+	routeAll    = "all"
+	routeChat   = "chat"
+
+	// routeRevoke carries no frame: instances close connections of Sessions
+	routeRevoke = "revoke"
+)
+
+// busFrame is one outbound frame on its way to the instances that hold the
+// target connections. Each instance delivers to its own connections as soon
+// as it publishes and ignores its own frames when they come back.
+//
+// Typing timers and group subscriptions stay local to the instance that owns
+// the connection; only the resulting frames cross the bus. Whether a user is
+// online comes from the connection counts each instance keeps in the database.
+type busFrame struct {
+	Origin   string          `json:"origin"`
+	Kind     string          `json:"kind"`
+	Nickname string          `json:"nickname,omitempty"`
+	UserID   int             `json:"user_id,omitempty"`
+	GroupID  int             `json:"group_id,omitempty"`
+	Except   string          `json:"except,omitempty"`
+	Chat     *ChatResponse   `json:"chat,omitempty"`
+	Sessions []string        `json:"sessions,omitempty"`
+	Type     string          `json:"type,omitempty"`
+	EventID  int             `json:"event_id,omitempty"`
+	Frame    json.RawMessage `json:"frame,omitempty"`
+}
+
+// busInboxSize bounds how many frames from other instances may wait for delivery
+const busInboxSize = 1024
+
+// instanceID tells this process's frames apart from other instances'
+var instanceID = uuid.New().String()
+
+var bus pubsub.Broker
+
+// Frames from other instances wait here for delivery. Direct messages have
+// their own queue: delivering them writes to the database and can wait for a
+// connection's history replay, which must not hold up everything else.
+var (
+	busInbox  = make(chan busFrame, busInboxSize)
+	chatInbox = make(chan busFrame, busInboxSize)
+)
+
+// StartBus starts delivering frames from other instances and routes every
+// WebSocket broadcast through b. Call it once, before serving connections.
+func StartBus(b pubsub.Broker) error {
+	go drainBusInbox(busInbox)
+	go drainBusInbox(chatInbox)
+	if err := b.Subscribe(busChannel, receiveBusFrame); err != nil {
+		return err
+	}
+	bus = b
+	return nil
+}
+
+// receiveBusFrame is the broker's subscriber callback. It runs on the
+// broker's reader goroutine, so it only queues the frame and never blocks.
+// A direct message dropped here stays undelivered in the database and is
+// replayed when the recipient reconnects.
+func receiveBusFrame(payload []byte) {
+	var f busFrame
+	if err := json.Unmarshal(payload, &f); err != nil {
+		log.Printf("Dropping malformed bus frame: %v", err)
+		return
+	}
+	if f.Origin == instanceID {
+		return
+	}
+
+	inbox := busInbox
+	if f.Kind == routeChat {
+		inbox = chatInbox
+	}
+	select {
+	case inbox <- f:
+	default:
+		log.Printf("Dropping %s bus frame: delivery queue is full", f.Kind)
+	}
+}
+
+// drainBusInbox delivers queued frames in the order they arrived
+func drainBusInbox(inbox <-chan busFrame) {
+	for f := range inbox {
+		deliverLocal(f)
+	}
+}
+
+// deliverLocal hands f to the connections held by this instance
+func deliverLocal(f busFrame) {
+	switch f.Kind {
+	case routeUser:
+		wsHub.SendToUser(f.Nickname, f.Frame)
+		if sseEventTypes[f.Type] {
+			eventStreams.sendToUser(f.Nickname, sseEvent{ID: f.EventID, Type: f.Type, Data: f.Frame})
+		}
+	case routeUserID:
+		wsHub.SendToUserID(f.UserID, f.Frame)
+		if sseEventTypes[f.Type] {
+			eventStreams.sendToUserID(f.UserID, sseEvent{ID: f.EventID, Type: f.Type, Data: f.Frame})
+		}
+	case routeGroup:
+		wsHub.BroadcastToGroupExcept(f.GroupID, f.Except, f.Frame)
+	case routeAll:
+		wsHub.Broadcast(f.Frame)
+	case routeChat:
+		if f.Chat != nil {
+			deliverChatToUser(f.Nickname, *f.Chat)
+		}
+	case routeRevoke:
+		wsHub.CloseSessions(f.Sessions)
+		eventStreams.closeSessions(f.Sessions)
+	default:
+		log.Printf("Dropping bus frame with unknown kind %q", f.Kind)
+	}
+}
+
+// publishRemote sends f to the other instances
+func publishRemote(f busFrame) {
+	f.Origin = instanceID
+	payload, err := json.Marshal(f)
+	if err != nil {
+		log.Println("Error marshaling bus frame:", err)
+		return
+	}
+	if err := bus.Publish(busChannel, payload); err != nil {
+		log.Printf("Failed to publish %s frame: %v", f.Kind, err)
+	}
+}
+
+// route delivers message locally and on every other instance
+func route(f busFrame, message interface{}) {
+	frame, err := json.Marshal(message)
+	if err != nil {
+		log.Println("Error marshaling WebSocket message:", err)
+		return
+	}
+	f.Frame = frame
+	if ws, ok := message.(WebSocketMessage); ok {
+		f.Type = ws.Type
+	}
+	deliverLocal(f)
+	publishRemote(f)
+}
+
+func publishToUser(nickname string, message interface{}) {
+	route(busFrame{Kind: routeUser, Nickname: nickname}, message)
+}
+
+func publishToUserID(userID int, message interface{}) {
+	route(busFrame{Kind: routeUserID, UserID: userID}, message)
+}
+
+// publishToGroup sends message to every connection subscribed to groupID,
+// except those of the user named in except (if any)
+func publishToGroup(groupID int, except string, message interface{}) {
+	route(busFrame{Kind: routeGroup, GroupID: groupID, Except: except}, message)
+}
+
+func publishToAll(message interface{}) {
+	route(busFrame{Kind: routeAll}, message)
+}
+
+// CloseRevokedSessions closes the WebSocket and event stream connections of
+// revoked sessions on every instance. It is hooked up as SessionStore.OnRevoke.
+func CloseRevokedSessions(sessionIDs []string) {
+	f := busFrame{Kind: routeRevoke, Sessions: sessionIDs}
+	deliverLocal(f)
+	publishRemote(f)
+}
+
+// publishToOtherDevices sends message to every connection of conn's user
+// but conn itself
+func publishToOtherDevices(conn *Connection, message interface{}) {
+	frame, err := json.Marshal(message)
+	if err != nil {
+		log.Println("Error marshaling WebSocket message:", err)
+		return
+	}
+	wsHub.SendToUserExcept(conn.nickname, conn, json.RawMessage(frame))
+	publishRemote(busFrame{Kind: routeUser, Nickname: conn.nickname, Frame: frame})
+}
+
+// publishChat delivers a saved direct message to the recipient wherever they
+// are connected. Each instance records delivery for its own connections.
+func publishChat(recipient string, response ChatResponse) {
+	f := busFrame{Kind: routeChat, Nickname: recipient, Chat: &response}
+	deliverLocal(f)
+	publishRemote(f)
+}
@@ -3,70 +3,158 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"socialhub/database"
+	"strconv"
 	// "your_project/database" // adjust path as needed
 )
 
+// ChatHistoryHandler - GET /chat/history?with=nickname returns a page of the
+// caller's direct messages with another user. The older user1/user2 form is
+// still accepted when one of the two is the caller.
 func ChatHistoryHandler(w http.ResponseWriter, r *http.Request) {
-	sender := r.URL.Query().Get("user1")
-	recipient := r.URL.Query().Get("user2")
+	userID := getUserIDFromContext(r.Context())
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	caller, err := database.GetNickname(userID)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-	fmt.Println("ChatHistoryHandler triggered")
-	fmt.Println("Query params:", sender, recipient)
+	params := r.URL.Query()
+	peer := params.Get("with")
+	if peer == "" {
+		user1, user2 := params.Get("user1"), params.Get("user2")
+		switch caller {
+		case user1:
+			peer = user2
+		case user2:
+			peer = user1
+		default:
+			if user1 != "" && user2 != "" {
+				http.Error(w, "You can only read your own chats", http.StatusForbidden)
+				return
+			}
+		}
+	}
+	if peer == "" {
+		http.Error(w, "Missing with query param", http.StatusBadRequest)
+		return
+	}
 
-	if sender == "" || recipient == "" {
-		http.Error(w, "Missing user1 or user2 query params", http.StatusBadRequest)
-		fmt.Println("Missing query params")
+	query, err := parseHistoryQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Participants may always read what they exchanged; otherwise the
+	// messaging policy decides
+	allowed, err := database.CanMessage(caller, peer)
+	if err == database.ErrUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err == nil && !allowed {
+		allowed, err = database.HasDirectMessages(caller, peer)
+	}
+	if err != nil {
+		log.Printf("Failed to check chat access of %s to %s: %v", caller, peer, err)
+		http.Error(w, "Failed to fetch chat history", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
 
-	history, err := database.GetChatHistory(sender, recipient)
+	history, err := database.GetChatHistory(caller, peer, query)
+	if err == database.ErrMessageNotFound {
+		http.Error(w, "Message not found in this conversation", http.StatusNotFound)
+		return
+	}
 	if err != nil {
+		log.Printf("Failed to get chat history of %s and %s: %v", caller, peer, err)
 		http.Error(w, "Failed to fetch chat history", http.StatusInternalServerError)
-		fmt.Println("Error getting chat history:", err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(history); err != nil {
-		http.Error(w, "Failed to encode chat history", http.StatusInternalServerError)
-		fmt.Println("Error encoding response:", err)
-		return
+		log.Printf("Failed to encode chat history: %v", err)
 	}
+}
 
-	fmt.Println("Chat history successfully sent")
+// parseHistoryQuery reads the before, after, around and limit parameters of
+// /chat/history. Only one of the three cursors may be given.
+func parseHistoryQuery(r *http.Request) (database.HistoryQuery, error) {
+	var q database.HistoryQuery
+	params := r.URL.Query()
+	cursors := 0
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{
+		{"before", &q.Before},
+		{"after", &q.After},
+		{"around", &q.Around},
+		{"limit", &q.Limit},
+	} {
+		raw := params.Get(p.name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.Atoi(raw)
+		if err != nil || v <= 0 {
+			return q, fmt.Errorf("Invalid %s parameter", p.name)
+		}
+		*p.dst = v
+		if p.name != "limit" {
+			cursors++
+		}
+	}
+	if cursors > 1 {
+		return q, fmt.Errorf("Only one of before, after and around may be set")
+	}
+	return q, nil
 }
 
 func CanAccessChatHandler(w http.ResponseWriter, r *http.Request) {
-	user := r.URL.Query().Get("user")
-	target := r.URL.Query().Get("target")
-
-	fmt.Println("CanAccessChatHandler called with:", user, target)
-
-	if user == "" || target == "" {
-		http.Error(w, "Missing user or target", http.StatusBadRequest)
+	userID := getUserIDFromContext(r.Context())
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// ✅ Check if target is public
-	isPublic, err := database.IsPublic(target)
+	user, err := database.GetNickname(userID)
 	if err != nil {
-		fmt.Println("Error in IsPublic:", err)
-		http.Error(w, "Failed to check public status", http.StatusInternalServerError)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	target := r.URL.Query().Get("target")
+
+	if target == "" {
+		http.Error(w, "Missing target", http.StatusBadRequest)
 		return
 	}
 
-	// ✅ Check if user follows the target (and is accepted)
-	isFollowing, err := database.IsFollowing(user, target)
+	// Same policy that is enforced on every chat frame over the WebSocket
+	allowed, err := database.CanMessage(user, target)
+	if err == database.ErrUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		fmt.Println("Error in IsFollowing:", err)
-		http.Error(w, "Failed to check following", http.StatusInternalServerError)
+		log.Printf("Failed to check chat access of %s to %s: %v", user, target, err)
+		http.Error(w, "Failed to check chat access", http.StatusInternalServerError)
 		return
 	}
 
-	// ✅ Grant access if target is public OR user follows target (accepted)
-	if isPublic || isFollowing {
+	if allowed {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]bool{"access": true})
 		return
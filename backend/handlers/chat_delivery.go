@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"log"
+	"socialhub/database"
+)
+
+// ResumeRequest is sent by clients that track the last message_id they have
+// seen. It can also be given as the resume_from query parameter on /ws.
+type ResumeRequest struct {
+	LastMessageID int `json:"last_message_id"`
+}
+
+// AckRequest confirms delivery of direct messages, either everything up to
+// MessageID or an explicit list of ids
+type AckRequest struct {
+	MessageID  int   `json:"message_id"`
+	MessageIDs []int `json:"message_ids"`
+}
+
+// replayMissedMessages sends the direct messages this connection has not seen.
+// With a resume cursor it sends everything after afterID and the client is
+// expected to ack. Without one it sends only undelivered messages and marks
+// them delivered straight away, which is what older clients rely on.
+//
+// chatMu is held for the whole replay so a message that is saved while the
+// replay runs is sent exactly once, either here or by deliverChat, and
+// messages already pushed live on this connection are skipped.
+func (c *Connection) replayMissedMessages(resume bool, afterID int) {
+	c.chatMu.Lock()
+	defer c.chatMu.Unlock()
+
+	var messages []database.Message
+	var err error
+	if resume {
+		c.acks = true
+		messages, err = database.GetMessagesForUserSince(c.nickname, afterID)
+	} else {
+		messages, err = database.GetMessagesForUser(c.nickname)
+	}
+	if err != nil {
+		log.Println("Error fetching pending messages:", err)
+		return
+	}
+
+	ids := make([]int, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.MessageID
+	}
+	attachments, err := database.AttachmentsForMessages(ids)
+	if err != nil {
+		log.Println("Error fetching attachments of pending messages:", err)
+	}
+
+	lastID := 0
+	for _, msg := range messages {
+		if c.liveSent[msg.MessageID] {
+			lastID = msg.MessageID
+			continue
+		}
+		response := ChatResponse{
+			MessageID:   msg.MessageID,
+			From:        msg.Sender,
+			To:          c.nickname,
+			Message:     msg.Message,
+			Timestamp:   msg.Timestamp,
+			Attachments: attachments[msg.MessageID],
+		}
+		if !c.SendJSONWait(WebSocketMessage{Type: "chat", Data: response}) {
+			break
+		}
+		lastID = msg.MessageID
+	}
+
+	if lastID > c.replayCursor {
+		c.replayCursor = lastID
+	}
+	// The cursor now covers these, so there is no need to remember them
+	for id := range c.liveSent {
+		if id <= c.replayCursor {
+			delete(c.liveSent, id)
+		}
+	}
+	if !c.acks && lastID > 0 {
+		if err := database.MarkMessagesAsDelivered(c.nickname, lastID); err != nil {
+			log.Println("Error marking replayed messages as delivered:", err)
+		}
+	}
+}
+
+// deliverChat queues a freshly saved direct message on this connection unless
+// the replay already sent it. It reports whether the connection accepted the
+// frame and will not ack it, i.e. whether the server should treat it as delivered.
+func (c *Connection) deliverChat(response ChatResponse) (queued bool, needsAck bool) {
+	c.chatMu.Lock()
+	defer c.chatMu.Unlock()
+
+	if response.MessageID <= c.replayCursor || c.liveSent[response.MessageID] {
+		return false, c.acks
+	}
+	queued = c.SendJSON(WebSocketMessage{Type: "chat", Data: response})
+	if queued {
+		c.liveSent[response.MessageID] = true
+	}
+	return queued, c.acks
+}
+
+// deliverChatToUser fans a saved direct message out to every connection of
+// the recipient and records delivery for connections that don't ack
+func deliverChatToUser(recipient string, response ChatResponse) {
+	deliveredWithoutAck := false
+	for _, c := range wsHub.userConns(recipient) {
+		queued, needsAck := c.deliverChat(response)
+		if queued && !needsAck {
+			deliveredWithoutAck = true
+		}
+	}
+	if deliveredWithoutAck {
+		if err := database.MarkMessageIDsAsDelivered(recipient, []int{response.MessageID}); err != nil {
+			log.Println("Error marking message as delivered:", err)
+		}
+	}
+}
+
+func handleResume(conn *Connection, frame InboundFrame) {
+	var req ResumeRequest
+	if !decodeFrame(conn, frame, &req) {
+		return
+	}
+
+	conn.replayMissedMessages(true, req.LastMessageID)
+	sendAck(conn, frame, AckResponse{})
+}
+
+// handleAck records the client's delivery acknowledgement. Acks are not
+// themselves acked.
+func handleAck(conn *Connection, frame InboundFrame) {
+	var ack AckRequest
+	if !decodeFrame(conn, frame, &ack) {
+		return
+	}
+
+	conn.chatMu.Lock()
+	conn.acks = true
+	conn.chatMu.Unlock()
+
+	if ack.MessageID > 0 {
+		if err := database.MarkMessagesAsDelivered(conn.nickname, ack.MessageID); err != nil {
+			log.Println("Error recording ack:", err)
+		}
+	}
+	if err := database.MarkMessageIDsAsDelivered(conn.nickname, ack.MessageIDs); err != nil {
+		log.Println("Error recording ack:", err)
+	}
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"socialhub/database"
+	"time"
+)
+
+var errChatTarget = errors.New("set exactly one of conversation_id and group_id")
+
+// ChatTargetRequest names the conversation or group a preference applies to
+type ChatTargetRequest struct {
+	ConversationID int `json:"conversation_id,omitempty"`
+	GroupID        int `json:"group_id,omitempty"`
+}
+
+// MuteChatRequest mutes for DurationSeconds, or until unmuted when Forever is
+// set. CountUnread keeps the chat in unread totals and defaults to true.
+type MuteChatRequest struct {
+	ChatTargetRequest
+	DurationSeconds int   `json:"duration_seconds,omitempty"`
+	Forever         bool  `json:"forever,omitempty"`
+	CountUnread     *bool `json:"count_unread,omitempty"`
+}
+
+type ArchiveChatRequest struct {
+	ChatTargetRequest
+	Archived bool `json:"archived"`
+}
+
+// chatTarget checks that the caller belongs to the requested chat and
+// returns its kind and id. Chats the caller isn't in are reported as not
+// found, like requireParticipant does.
+func chatTarget(userID int, nickname string, req ChatTargetRequest) (string, int, error) {
+	switch {
+	case req.ConversationID > 0 && req.GroupID == 0:
+		if err := requireParticipant(req.ConversationID, nickname); err != nil {
+			return "", 0, err
+		}
+		return database.ChatKindConversation, req.ConversationID, nil
+	case req.GroupID > 0 && req.ConversationID == 0:
+		var memberCount int
+		err := database.Db.QueryRow("SELECT COUNT(*) FROM group_members WHERE group_id = ? AND user_id = ?",
+			req.GroupID, userID).Scan(&memberCount)
+		if err != nil {
+			return "", 0, err
+		}
+		if memberCount == 0 {
+			return "", 0, database.ErrConversationNotFound
+		}
+		return database.ChatKindGroup, req.GroupID, nil
+	default:
+		return "", 0, errChatTarget
+	}
+}
+
+func writeChatTargetError(w http.ResponseWriter, err error) {
+	switch err {
+	case errChatTarget:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case database.ErrConversationNotFound, database.ErrGroupNotFound:
+		http.Error(w, "Chat not found", http.StatusNotFound)
+	default:
+		log.Printf("Failed to update chat preference: %v", err)
+		http.Error(w, "Failed to update chat preference", http.StatusInternalServerError)
+	}
+}
+
+// chatMuted reports whether userID muted a chat. Lookup errors are logged and
+// treated as not muted so notifications are never lost to them.
+func chatMuted(userID int, kind string, targetID int) bool {
+	muted, err := database.IsChatMuted(userID, kind, targetID)
+	if err != nil {
+		log.Printf("Failed to check mute of %s %d for user %d: %v", kind, targetID, userID, err)
+		return false
+	}
+	return muted
+}
+
+// notifyDirectMessage creates the new message notification for a DM unless
+// the recipient muted the conversation
+func notifyDirectMessage(recipientID int, sender, recipient string) {
+	conversationID, err := database.GetOrCreateDirectConversation(sender, recipient)
+	if err != nil {
+		log.Printf("Failed to look up conversation %s -> %s: %v", sender, recipient, err)
+	} else if chatMuted(recipientID, database.ChatKindConversation, conversationID) {
+		return
+	}
+	CreateNewMessageNotification(recipientID, sender)
+}
+
+// preferenceRequest handles the shared part of the mute, unmute and archive
+// endpoints: method, session and decoding the body into req
+func preferenceRequest(w http.ResponseWriter, r *http.Request, req interface{}) (int, string, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return 0, "", false
+	}
+	nickname, ok := sessionNickname(w, r)
+	if !ok {
+		return 0, "", false
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return 0, "", false
+	}
+	return getUserIDFromContext(r.Context()), nickname, true
+}
+
+// writeChatPreference answers with the new preference and tells the user's
+// other devices about it
+func writeChatPreference(w http.ResponseWriter, userID int, pref *database.ChatPreference) {
+	publishToUserID(userID, WebSocketMessage{Type: "chat_preference_updated", Data: pref})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pref)
+}
+
+// MuteChatHandler - POST /chat/mute {"group_id": 1, "duration_seconds": 3600}
+// or {"conversation_id": 1, "forever": true, "count_unread": false}
+func MuteChatHandler(w http.ResponseWriter, r *http.Request) {
+	var req MuteChatRequest
+	userID, nickname, ok := preferenceRequest(w, r, &req)
+	if !ok {
+		return
+	}
+	if req.Forever == (req.DurationSeconds > 0) || req.DurationSeconds < 0 {
+		http.Error(w, "Set either duration_seconds or forever", http.StatusBadRequest)
+		return
+	}
+	kind, targetID, err := chatTarget(userID, nickname, req.ChatTargetRequest)
+	if err != nil {
+		writeChatTargetError(w, err)
+		return
+	}
+
+	var until *time.Time
+	if !req.Forever {
+		t := time.Now().Add(time.Duration(req.DurationSeconds) * time.Second)
+		until = &t
+	}
+	countUnread := req.CountUnread == nil || *req.CountUnread
+
+	pref, err := database.MuteChat(userID, kind, targetID, until, countUnread)
+	if err != nil {
+		writeChatTargetError(w, err)
+		return
+	}
+	writeChatPreference(w, userID, pref)
+}
+
+// UnmuteChatHandler - POST /chat/unmute {"group_id": 1}
+func UnmuteChatHandler(w http.ResponseWriter, r *http.Request) {
+	var req ChatTargetRequest
+	userID, nickname, ok := preferenceRequest(w, r, &req)
+	if !ok {
+		return
+	}
+	kind, targetID, err := chatTarget(userID, nickname, req)
+	if err != nil {
+		writeChatTargetError(w, err)
+		return
+	}
+	pref, err := database.UnmuteChat(userID, kind, targetID)
+	if err != nil {
+		writeChatTargetError(w, err)
+		return
+	}
+	writeChatPreference(w, userID, pref)
+}
+
+// ArchiveChatHandler - POST /chat/archive {"conversation_id": 1, "archived": true}
+func ArchiveChatHandler(w http.ResponseWriter, r *http.Request) {
+	var req ArchiveChatRequest
+	userID, nickname, ok := preferenceRequest(w, r, &req)
+	if !ok {
+		return
+	}
+	kind, targetID, err := chatTarget(userID, nickname, req.ChatTargetRequest)
+	if err != nil {
+		writeChatTargetError(w, err)
+		return
+	}
+	pref, err := database.SetChatArchived(userID, kind, targetID, req.Archived)
+	if err != nil {
+		writeChatTargetError(w, err)
+		return
+	}
+	writeChatPreference(w, userID, pref)
+}
+
+// ChatPreferencesHandler - GET /chat/preferences lists the caller's muted and archived chats
+func ChatPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := getUserIDFromContext(r.Context())
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	prefs, err := database.ListChatPreferences(userID)
+	if err != nil {
+		http.Error(w, "Failed to load chat preferences", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
@@ -0,0 +1,472 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"socialhub/database"
+	"strconv"
+	"time"
+)
+
+// Error codes for conversation frames
+const (
+	ErrCodeConversationNotFound = "conversation_not_found"
+	ErrCodeNotParticipant       = "not_participant"
+	ErrCodeDirectConversation   = "direct_conversation"
+)
+
+var errCannotAddParticipant = errors.New("you can't start a conversation with one of these users")
+
+type CreateConversationRequest struct {
+	Title        *string  `json:"title"`
+	Participants []string `json:"participants"`
+}
+
+type RenameConversationRequest struct {
+	ConversationID int     `json:"conversation_id"`
+	Title          *string `json:"title"`
+}
+
+type ConversationParticipantsRequest struct {
+	ConversationID int      `json:"conversation_id"`
+	Participants   []string `json:"participants"`
+}
+
+type LeaveConversationRequest struct {
+	ConversationID int `json:"conversation_id"`
+}
+
+// ConversationChatMessage is the data of an inbound "conversation_message" frame
+type ConversationChatMessage struct {
+	ConversationID int    `json:"conversation_id"`
+	Content        string `json:"content"`
+	Attachments    []int  `json:"attachments,omitempty"`
+}
+
+type ConversationChatResponse struct {
+	MessageID      int                   `json:"message_id"`
+	ConversationID int                   `json:"conversation_id"`
+	Sender         string                `json:"sender"`
+	Content        string                `json:"content"`
+	Timestamp      string                `json:"timestamp"`
+	Attachments    []database.Attachment `json:"attachments,omitempty"`
+}
+
+// ConversationEvent is pushed as "conversation_updated" when a conversation is
+// created, renamed, joined or left
+type ConversationEvent struct {
+	Action       string                 `json:"action"`
+	Actor        string                 `json:"actor"`
+	Conversation *database.Conversation `json:"conversation"`
+}
+
+// conversationError maps database errors to a WebSocket error code and HTTP status
+func conversationError(err error) (string, int) {
+	switch err {
+	case database.ErrConversationNotFound:
+		return ErrCodeConversationNotFound, http.StatusNotFound
+	case database.ErrNotParticipant:
+		return ErrCodeNotParticipant, http.StatusForbidden
+	case database.ErrDirectConversation:
+		return ErrCodeDirectConversation, http.StatusBadRequest
+	case database.ErrUserNotFound:
+		return ErrCodeUserNotFound, http.StatusNotFound
+	case errCannotAddParticipant:
+		return ErrCodeChatForbidden, http.StatusForbidden
+	default:
+		return ErrCodeInternal, http.StatusInternalServerError
+	}
+}
+
+func writeConversationError(w http.ResponseWriter, err error) {
+	_, status := conversationError(err)
+	if status == http.StatusInternalServerError {
+		log.Println("Conversation error:", err)
+		http.Error(w, "Internal server error", status)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// publishToConversation sends message to every current participant
+func publishToConversation(conversationID int, message interface{}) {
+	participants, err := database.GetConversationParticipants(conversationID)
+	if err != nil {
+		log.Printf("Failed to load participants of conversation %d: %v", conversationID, err)
+		return
+	}
+	for _, nickname := range participants {
+		publishToUser(nickname, message)
+	}
+}
+
+// announceConversation tells the participants, and anyone in extra who just
+// left, that the conversation changed
+func announceConversation(action, actor string, c *database.Conversation, extra ...string) {
+	message := WebSocketMessage{Type: "conversation_updated", Data: ConversationEvent{
+		Action:       action,
+		Actor:        actor,
+		Conversation: c,
+	}}
+	for _, nickname := range append(c.Participants, extra...) {
+		publishToUser(nickname, message)
+	}
+}
+
+// checkCanAdd applies the direct message policy to everyone actor brings in
+func checkCanAdd(actor string, nicknames []string) error {
+	for _, nickname := range nicknames {
+		allowed, err := database.CanMessage(actor, nickname)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return errCannotAddParticipant
+		}
+	}
+	return nil
+}
+
+// uniqueOthers drops duplicates, empty names and actor from nicknames
+func uniqueOthers(actor string, nicknames []string) []string {
+	seen := map[string]bool{actor: true, "": true}
+	var others []string
+	for _, n := range nicknames {
+		if !seen[n] {
+			seen[n] = true
+			others = append(others, n)
+		}
+	}
+	return others
+}
+
+func sessionNickname(w http.ResponseWriter, r *http.Request) (string, bool) {
+	nickname, err := database.GetNickname(getUserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	return nickname, true
+}
+
+func writeConversation(w http.ResponseWriter, c interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// ConversationsHandler - GET /conversations lists the caller's conversations
+// (archived ones only with ?archived=1, and then only those),
+// POST /conversations {"title": "...", "participants": ["a", "b"]} starts one.
+// A single participant without a title gives the 1:1 conversation.
+func ConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	nickname, ok := sessionNickname(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		conversations, err := database.ListConversations(nickname)
+		if err != nil {
+			writeConversationError(w, err)
+			return
+		}
+		prefs, err := database.ChatPreferencesByTarget(getUserIDFromContext(r.Context()), database.ChatKindConversation)
+		if err != nil {
+			writeConversationError(w, err)
+			return
+		}
+		wantArchived := r.URL.Query().Get("archived") == "1"
+		listed := []database.Conversation{}
+		for _, c := range conversations {
+			pref := prefs[c.ID]
+			if pref.Archived != wantArchived {
+				continue
+			}
+			c.Muted, c.Archived = pref.Muted, pref.Archived
+			listed = append(listed, c)
+		}
+		writeConversation(w, listed)
+	case http.MethodPost:
+		var req CreateConversationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		others := uniqueOthers(nickname, req.Participants)
+		if len(others) == 0 {
+			http.Error(w, "A conversation needs at least one other participant", http.StatusBadRequest)
+			return
+		}
+		if err := checkCanAdd(nickname, others); err != nil {
+			writeConversationError(w, err)
+			return
+		}
+
+		var c *database.Conversation
+		var err error
+		if len(others) == 1 && req.Title == nil {
+			var id int
+			if id, err = database.GetOrCreateDirectConversation(nickname, others[0]); err == nil {
+				c, err = database.GetConversation(id)
+			}
+		} else {
+			c, err = database.CreateConversation(nickname, req.Title, others)
+		}
+		if err != nil {
+			writeConversationError(w, err)
+			return
+		}
+		if c.Kind == database.ConversationGroup {
+			announceConversation("created", nickname, c)
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeConversation(w, c)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GetConversationHandler - GET /conversations/get?id=1
+func GetConversationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nickname, ok := sessionNickname(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	if err := requireParticipant(id, nickname); err != nil {
+		writeConversationError(w, err)
+		return
+	}
+	c, err := database.GetConversation(id)
+	if err != nil {
+		writeConversationError(w, err)
+		return
+	}
+	writeConversation(w, c)
+}
+
+// requireParticipant returns ErrConversationNotFound for conversations the
+// caller isn't in, so ids don't reveal which conversations exist
+func requireParticipant(id int, nickname string) error {
+	ok, err := database.IsConversationParticipant(id, nickname)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return database.ErrConversationNotFound
+	}
+	return nil
+}
+
+// RenameConversationHandler - POST /conversations/rename {"conversation_id": 1, "title": "..."}
+func RenameConversationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nickname, ok := sessionNickname(w, r)
+	if !ok {
+		return
+	}
+	var req RenameConversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ConversationID == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	c, err := database.RenameConversation(req.ConversationID, nickname, req.Title)
+	if err != nil {
+		writeConversationError(w, err)
+		return
+	}
+	announceConversation("renamed", nickname, c)
+	writeConversation(w, c)
+}
+
+// AddConversationParticipantsHandler - POST /conversations/participants
+// {"conversation_id": 1, "participants": ["c"]}
+func AddConversationParticipantsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nickname, ok := sessionNickname(w, r)
+	if !ok {
+		return
+	}
+	var req ConversationParticipantsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ConversationID == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	others := uniqueOthers(nickname, req.Participants)
+	if len(others) == 0 {
+		http.Error(w, "No participants to add", http.StatusBadRequest)
+		return
+	}
+	if err := checkCanAdd(nickname, others); err != nil {
+		writeConversationError(w, err)
+		return
+	}
+	c, err := database.AddConversationParticipants(req.ConversationID, nickname, others)
+	if err != nil {
+		writeConversationError(w, err)
+		return
+	}
+	announceConversation("joined", nickname, c)
+	writeConversation(w, c)
+}
+
+// LeaveConversationHandler - POST /conversations/leave {"conversation_id": 1}
+func LeaveConversationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nickname, ok := sessionNickname(w, r)
+	if !ok {
+		return
+	}
+	var req LeaveConversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ConversationID == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	c, err := database.LeaveConversation(req.ConversationID, nickname)
+	if err != nil {
+		writeConversationError(w, err)
+		return
+	}
+	announceConversation("left", nickname, c, nickname)
+	writeConversation(w, c)
+}
+
+// ConversationMessagesHandler - GET /conversations/messages?id=1&before=&after=&limit=
+func ConversationMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nickname, ok := sessionNickname(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	query, err := parseHistoryQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.Around > 0 {
+		http.Error(w, "around is not supported for conversations", http.StatusBadRequest)
+		return
+	}
+	if err := requireParticipant(id, nickname); err != nil {
+		writeConversationError(w, err)
+		return
+	}
+	history, err := database.GetConversationHistory(id, query)
+	if err != nil {
+		writeConversationError(w, err)
+		return
+	}
+	writeConversation(w, history)
+}
+
+// handleConversationMessage sends a message to a conversation. Direct
+// conversations go through the normal chat path so delivery tracking,
+// resume and read receipts keep working for them.
+func handleConversationMessage(conn *Connection, frame InboundFrame) {
+	var req ConversationChatMessage
+	if !decodeFrame(conn, frame, &req) {
+		return
+	}
+	if req.ConversationID == 0 || (req.Content == "" && len(req.Attachments) == 0) {
+		sendError(conn, frame, ErrCodeInvalidMessage, "Missing conversation_id or content", "")
+		return
+	}
+
+	if err := requireParticipant(req.ConversationID, conn.nickname); err != nil {
+		code, _ := conversationError(err)
+		sendError(conn, frame, code, err.Error(), "")
+		return
+	}
+	c, err := database.GetConversation(req.ConversationID)
+	if err != nil {
+		code, _ := conversationError(err)
+		sendError(conn, frame, code, err.Error(), "")
+		return
+	}
+
+	if c.Kind == database.ConversationDirect {
+		to := conn.nickname
+		for _, p := range c.Participants {
+			if p != conn.nickname {
+				to = p
+			}
+		}
+		data, _ := json.Marshal(ChatMessage{To: to, Message: req.Content, Attachments: req.Attachments})
+		handlePrivateChat(conn, InboundFrame{Type: frame.Type, Version: frame.Version, RequestID: frame.RequestID, Data: data})
+		return
+	}
+
+	if !checkFrameAttachments(conn, frame, req.Attachments, "") {
+		return
+	}
+
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	messageID, attachments, err := database.SaveConversationMessage(c.ID, conn.nickname, req.Content, timestamp, req.Attachments)
+	if err == database.ErrAttachmentNotUsable {
+		sendError(conn, frame, ErrCodeAttachmentInvalid, err.Error(), "")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save conversation message: %v", err)
+		sendError(conn, frame, ErrCodeInternal, "Failed to save message", "")
+		return
+	}
+
+	message := WebSocketMessage{Type: "conversation_message", Data: ConversationChatResponse{
+		MessageID:      messageID,
+		ConversationID: c.ID,
+		Sender:         conn.nickname,
+		Content:        req.Content,
+		Timestamp:      timestamp,
+		Attachments:    attachments,
+	}}
+	for _, p := range c.Participants {
+		if p != conn.nickname {
+			publishToUser(p, message)
+		}
+	}
+	publishToOtherDevices(conn, message)
+	sendAck(conn, frame, AckResponse{MessageID: messageID, Timestamp: timestamp})
+
+	for _, p := range c.Participants {
+		if p == conn.nickname {
+			continue
+		}
+		recipientID, err := database.GetUserIDByNickname(p)
+		if err != nil {
+			log.Printf("Failed to get user ID for %s: %v", p, err)
+			continue
+		}
+		if !chatMuted(recipientID, database.ChatKindConversation, c.ID) {
+			CreateNewMessageNotification(recipientID, conn.nickname)
+		}
+	}
+}
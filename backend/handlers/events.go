@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"socialhub/database"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	sseBufferSize  = 64
+	sseKeepAlive   = 25 * time.Second
+	sseRetryMillis = 3000
+	sseReplayLimit = 500
+)
+
+// sseEventTypes are the WebSocket frame types also sent on /events
+var sseEventTypes = map[string]bool{
+	"notification":              true,
+	"notification_update":       true,
+	"event_notification_update": true,
+	"follow_status_update":      true,
+	"group_invite":              true,
+	"group_join_request":        true,
+}
+
+// sseEvent is one frame for an event stream. ID is the notifications row for
+// "notification" events and zero for everything else.
+type sseEvent struct {
+	ID   int
+	Type string
+	Data json.RawMessage
+}
+
+type sseClient struct {
+	userID   int
+	nickname string
+	session  string
+	events   chan sseEvent
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (c *sseClient) close() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// send queues ev without blocking. A client that can't keep up is dropped
+// and catches up with Last-Event-ID when it reconnects.
+func (c *sseClient) send(ev sseEvent) {
+	select {
+	case c.events <- ev:
+	case <-c.done:
+	default:
+		log.Printf("Event stream for %s is full, closing it", c.nickname)
+		c.close()
+	}
+}
+
+// sseRegistry holds the open /events streams by nickname
+type sseRegistry struct {
+	mu      sync.RWMutex
+	clients map[string]map[*sseClient]struct{}
+}
+
+var eventStreams = &sseRegistry{clients: make(map[string]map[*sseClient]struct{})}
+
+func (r *sseRegistry) add(c *sseClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.clients[c.nickname] == nil {
+		r.clients[c.nickname] = make(map[*sseClient]struct{})
+	}
+	r.clients[c.nickname][c] = struct{}{}
+}
+
+func (r *sseRegistry) remove(c *sseClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clients[c.nickname], c)
+	if len(r.clients[c.nickname]) == 0 {
+		delete(r.clients, c.nickname)
+	}
+}
+
+func (r *sseRegistry) sendToUser(nickname string, ev sseEvent) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for c := range r.clients[nickname] {
+		c.send(ev)
+	}
+}
+
+func (r *sseRegistry) closeSessions(sessionIDs []string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, set := range r.clients {
+		for c := range set {
+			for _, id := range sessionIDs {
+				if c.session == id {
+					c.close()
+				}
+			}
+		}
+	}
+}
+
+func (r *sseRegistry) sendToUserID(userID int, ev sseEvent) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, set := range r.clients {
+		for c := range set {
+			if c.userID == userID {
+				c.send(ev)
+			}
+		}
+	}
+}
+
+// EventsHandler - GET /events streams the caller's notifications and request
+// updates as Server-Sent Events, for clients that can't keep a WebSocket
+// open. Each event carries the same JSON envelope as the socket frame. On
+// reconnect, notifications after Last-Event-ID are replayed from the database.
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := getUserIDFromContext(r.Context())
+	nickname, err := database.GetNickname(userID)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lastEventID := 0
+	if raw := r.Header.Get("Last-Event-ID"); raw != "" {
+		lastEventID, _ = strconv.Atoi(raw)
+	} else if raw := r.URL.Query().Get("last_event_id"); raw != "" {
+		lastEventID, _ = strconv.Atoi(raw)
+	}
+
+	// Register before replaying so nothing created in between is missed;
+	// live notifications the replay already covered are skipped below
+	var session string
+	if cookie, err := r.Cookie("session_id"); err == nil {
+		session = cookie.Value
+	}
+	client := &sseClient{
+		userID:   userID,
+		nickname: nickname,
+		session:  session,
+		events:   make(chan sseEvent, sseBufferSize),
+		done:     make(chan struct{}),
+	}
+	eventStreams.add(client)
+	defer eventStreams.remove(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetryMillis)
+
+	if lastEventID > 0 {
+		replayed, err := replayNotifications(w, userID, lastEventID)
+		if err != nil {
+			log.Printf("Failed to replay notifications for %s: %v", nickname, err)
+		}
+		if replayed > lastEventID {
+			lastEventID = replayed
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case ev := <-client.events:
+			if ev.ID > 0 && ev.ID <= lastEventID {
+				continue
+			}
+			if err := writeSSE(w, ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-client.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// replayNotifications writes the user's notifications newer than afterID and
+// returns the highest id written
+func replayNotifications(w http.ResponseWriter, userID, afterID int) (int, error) {
+	rows, err := database.Db.Query(`
+		SELECT id, type, message, related_id, created_at
+		FROM notifications
+		WHERE user_id = ? AND id > ?
+		ORDER BY id ASC
+		LIMIT ?
+	`, userID, afterID, sseReplayLimit)
+	if err != nil {
+		return afterID, err
+	}
+	defer rows.Close()
+
+	lastID := afterID
+	for rows.Next() {
+		var (
+			id                        int
+			notificationType, message string
+			relatedID                 *int
+			createdAt                 time.Time
+		)
+		if err := rows.Scan(&id, &notificationType, &message, &relatedID, &createdAt); err != nil {
+			return lastID, err
+		}
+		// CreateNotification stores local wall-clock time without a zone
+		createdAt = time.Date(createdAt.Year(), createdAt.Month(), createdAt.Day(),
+			createdAt.Hour(), createdAt.Minute(), createdAt.Second(), 0, time.Local)
+		frame, err := json.Marshal(WebSocketMessage{
+			Type: "notification",
+			Data: map[string]interface{}{
+				"id":         id,
+				"type":       notificationType,
+				"message":    message,
+				"related_id": relatedID,
+				"timestamp":  createdAt.Unix(),
+			},
+		})
+		if err != nil {
+			return lastID, err
+		}
+		if err := writeSSE(w, sseEvent{ID: id, Type: "notification", Data: frame}); err != nil {
+			return lastID, err
+		}
+		lastID = id
+	}
+	return lastID, rows.Err()
+}
+
+func writeSSE(w http.ResponseWriter, ev sseEvent) error {
+	if ev.ID > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", ev.ID); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, ev.Data)
+	return err
+}
@@ -5,7 +5,6 @@ import (
 	"net/http"
 	"socialhub/database"
 	"strconv"
-	"time"
 )
 
 type CreateGroupEventRequest struct {
@@ -50,36 +49,22 @@ func GetGroupMessagesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := database.Db.Query(`
-		SELECT users.nickname, gm.message, gm.created_at
-		FROM group_messages gm
-		JOIN users ON gm.user_id = users.uid
-		WHERE gm.group_id = ?
-		ORDER BY gm.created_at ASC
-	`, groupID)
+	query, err := parseHistoryQuery(r)
 	if err != nil {
-		http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
-
-	var messages []map[string]interface{}
-	for rows.Next() {
-		var sender, content string
-		var timestamp time.Time
 
-		if err := rows.Scan(&sender, &content, &timestamp); err != nil {
-			http.Error(w, "Scan error: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		messages = append(messages, map[string]interface{}{
-			"sender":    sender,
-			"content":   content,
-			"timestamp": timestamp,
-		})
+	history, err := database.GetGroupHistory(groupID, currentUserID, query)
+	if err == database.ErrMessageNotFound {
+		http.Error(w, "Message not found in this group", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(messages)
+	json.NewEncoder(w).Encode(history)
 }
\ No newline at end of file
@@ -30,6 +30,12 @@ func GetGroupNotificationsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	prefs, err := database.ChatPreferencesByTarget(currentUserID, database.ChatKindGroup)
+	if err != nil {
+		http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Get all groups the user is a member of with their unread counts
 	rows, err := database.Db.Query(`
 		SELECT 
@@ -61,12 +67,19 @@ func GetGroupNotificationsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		totalUnread += unreadCount
+		// Muted groups only count toward the total if the user asked for that
+		pref, ok := prefs[groupID]
+		if !ok || !pref.Muted || pref.CountUnread {
+			totalUnread += unreadCount
+		}
 
 		notifications = append(notifications, map[string]interface{}{
 			"group_id":     groupID,
 			"group_name":   groupName,
 			"unread_count": unreadCount,
+			"muted":        pref.Muted,
+			"muted_until":  pref.MutedUntil,
+			"archived":     pref.Archived,
 		})
 	}
 
@@ -79,7 +92,8 @@ func GetGroupNotificationsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// MarkGroupAsReadHandler marks all messages in a group as read for the current user
+// MarkGroupAsReadHandler marks a group's messages as read for the current user,
+// up to the message_id query parameter or all of them when it is omitted
 func MarkGroupAsReadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -108,26 +122,86 @@ func MarkGroupAsReadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get the latest message ID for this group
-	var latestMessageID int
-	err = database.Db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM group_messages WHERE group_id = ?", groupID).Scan(&latestMessageID)
+	// Mark up to message_id, or everything when it is omitted
+	messageID := 0
+	if raw := r.URL.Query().Get("message_id"); raw != "" {
+		messageID, err = strconv.Atoi(raw)
+		if err != nil || messageID <= 0 {
+			http.Error(w, "Invalid message_id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	nickname, err := database.GetNickname(currentUserID)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	lastReadID, err := markGroupRead(groupID, currentUserID, nickname, messageID)
+	if err == database.ErrMessageNotFound {
+		http.Error(w, "Message not found in this group", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Insert or update the notification record
-	_, err = database.Db.Exec(`
-		INSERT OR REPLACE INTO group_message_notifications (group_id, user_id, last_read_message_id, unread_count)
-		VALUES (?, ?, ?, 0)
-	`, groupID, currentUserID, latestMessageID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "last_read_message_id": lastReadID})
+}
+
+// GroupMessageSeenByHandler - GET /group-messages/seen?group_id=1&message_id=2
+// lists the members who have read up to the message
+func GroupMessageSeenByHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	currentUserID := getUserIDFromContext(r.Context())
+	if currentUserID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	groupID, err := strconv.Atoi(r.URL.Query().Get("group_id"))
+	if err != nil {
+		http.Error(w, "Invalid group_id", http.StatusBadRequest)
+		return
+	}
+	messageID, err := strconv.Atoi(r.URL.Query().Get("message_id"))
+	if err != nil || messageID <= 0 {
+		http.Error(w, "Invalid message_id", http.StatusBadRequest)
+		return
+	}
+
+	var memberCount int
+	err = database.Db.QueryRow("SELECT COUNT(*) FROM group_members WHERE group_id = ? AND user_id = ?",
+		groupID, currentUserID).Scan(&memberCount)
+	if err != nil || memberCount == 0 {
+		http.Error(w, "Access denied - not a group member", http.StatusForbidden)
+		return
+	}
+
+	readers, audience, err := database.GroupMessageSeenBy(groupID, messageID)
+	if err == database.ErrMessageNotFound {
+		http.Error(w, "Message not found in this group", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message_id":   messageID,
+		"seen_by":      readers,
+		"seen_count":   len(readers),
+		"member_count": audience,
+	})
 }
 
 // UpdateUnreadCounts updates unread counts for all group members when a new message is sent
@@ -155,11 +229,12 @@ func UpdateUnreadCounts(groupID int, senderID int) error {
 			continue
 		}
 
-		// Use INSERT OR REPLACE to handle both insert and update cases atomically
+		// Upsert so the member's last_read_message_id survives the increment
 		_, err = tx.Exec(`
-			INSERT OR REPLACE INTO group_message_notifications (group_id, user_id, unread_count) 
-			VALUES (?, ?, COALESCE((SELECT unread_count FROM group_message_notifications WHERE group_id = ? AND user_id = ?), 0) + 1)
-		`, groupID, userID, groupID, userID)
+			INSERT INTO group_message_notifications (group_id, user_id, unread_count)
+			VALUES (?, ?, 1)
+			ON CONFLICT(group_id, user_id) DO UPDATE SET unread_count = unread_count + 1
+		`, groupID, userID)
 
 		if err != nil {
 			fmt.Printf("Failed to update unread count for user %d: %v\n", userID, err)
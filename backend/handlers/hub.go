@@ -0,0 +1,450 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sendBufferSize is how many outbound frames a connection may have queued
+// before it is treated as a slow consumer.
+const sendBufferSize = 256
+
+// Default heartbeat timings. PingInterval must be shorter than PongWait so a
+// healthy client always answers before its read deadline passes.
+const (
+	defaultPingInterval = 30 * time.Second
+	defaultPongWait     = 60 * time.Second
+	defaultWriteWait    = 10 * time.Second
+)
+
+// SlowConsumerPolicy decides what happens when a connection's outbound queue is full
+type SlowConsumerPolicy int
+
+const (
+	// EvictSlowConsumer closes the connection so its read loop runs cleanup
+	EvictSlowConsumer SlowConsumerPolicy = iota
+	// DropFrame discards the frame and keeps the connection open
+	DropFrame
+)
+
+type Connection struct {
+	hub      *Hub
+	conn     *websocket.Conn
+	userID   int
+	nickname string
+	session  string // the session token the socket authenticated with
+	protocol int
+	groups   map[int]bool // guarded by hub.mu
+
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// chatMu serialises direct message delivery with the reconnect replay.
+	// replayCursor is the highest message_id the replay sent, liveSent the ids
+	// pushed live on this connection, and acks is set once the client has
+	// shown it acknowledges messages itself.
+	chatMu       sync.Mutex
+	replayCursor int
+	liveSent     map[int]bool
+	acks         bool
+}
+
+// connSet is the set of live connections for one user or one group
+type connSet map[*Connection]struct{}
+
+// Hub owns every live WebSocket connection and the group subscriptions.
+// A user may hold several connections at once (one per tab or device).
+// All access to the connection maps goes through its mutex; writes to a
+// socket only ever happen on that connection's writePump goroutine.
+type Hub struct {
+	mu     sync.RWMutex
+	users  map[string]connSet
+	groups map[int]connSet
+
+	Policy SlowConsumerPolicy
+
+	// PingInterval is how often the server pings each connection, PongWait how
+	// long it waits for any frame or pong before declaring the peer dead, and
+	// WriteWait the deadline for a single write.
+	PingInterval time.Duration
+	PongWait     time.Duration
+	WriteWait    time.Duration
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		users:        make(map[string]connSet),
+		groups:       make(map[int]connSet),
+		Policy:       EvictSlowConsumer,
+		PingInterval: defaultPingInterval,
+		PongWait:     defaultPongWait,
+		WriteWait:    defaultWriteWait,
+	}
+}
+
+// ConfigureHeartbeat overrides the heartbeat timings of the shared hub.
+// Zero values keep the current setting.
+func ConfigureHeartbeat(pingInterval, pongWait, writeWait time.Duration) {
+	if pingInterval > 0 {
+		wsHub.PingInterval = pingInterval
+	}
+	if pongWait > 0 {
+		wsHub.PongWait = pongWait
+	}
+	if writeWait > 0 {
+		wsHub.WriteWait = writeWait
+	}
+	if wsHub.PingInterval >= wsHub.PongWait {
+		wsHub.PingInterval = wsHub.PongWait * 9 / 10
+		log.Printf("WebSocket ping interval must be shorter than pong wait, using %s", wsHub.PingInterval)
+	}
+}
+
+var wsHub = NewHub()
+
+func newConnection(h *Hub, conn *websocket.Conn, userID int, nickname string) *Connection {
+	return &Connection{
+		hub:      h,
+		conn:     conn,
+		userID:   userID,
+		nickname: nickname,
+		protocol: ProtocolV1,
+		groups:   make(map[int]bool),
+		send:     make(chan []byte, sendBufferSize),
+		done:     make(chan struct{}),
+		liveSent: make(map[int]bool),
+	}
+}
+
+// writePump drains the outbound queue and sends periodic pings. It is the
+// only goroutine that writes to the socket, and closes it when it returns.
+func (c *Connection) writePump() {
+	ticker := time.NewTicker(c.hub.PingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.WriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Printf("Error writing to %s: %v", c.nickname, err)
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.WriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Printf("Ping to %s failed, closing connection: %v", c.nickname, err)
+				c.close()
+				return
+			}
+		case <-c.done:
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.WriteWait))
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+	}
+}
+
+// startHeartbeat arms the read deadline and extends it whenever the peer
+// answers a ping. A half-open connection then fails its next read, which
+// sends it through the normal cleanup path.
+func (c *Connection) startHeartbeat() {
+	c.extendReadDeadline()
+	c.conn.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		presence.heartbeat(c.nickname)
+		return nil
+	})
+}
+
+func (c *Connection) extendReadDeadline() {
+	c.conn.SetReadDeadline(time.Now().Add(c.hub.PongWait))
+}
+
+// close shuts the connection down once. writePump sends the close frame and
+// closes the socket; the read loop then fails and runs cleanup.
+func (c *Connection) close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// enqueue queues an already encoded frame without blocking the caller
+func (c *Connection) enqueue(data []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- data:
+		return true
+	default:
+	}
+
+	if c.hub.Policy == DropFrame {
+		log.Printf("Outbound queue full for %s, dropping frame", c.nickname)
+		return false
+	}
+	log.Printf("Outbound queue full for %s, evicting slow consumer", c.nickname)
+	c.close()
+	return false
+}
+
+// SendJSON encodes message and queues it on this connection
+func (c *Connection) SendJSON(message interface{}) bool {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Println("Error marshaling WebSocket message:", err)
+		return false
+	}
+	return c.enqueue(data)
+}
+
+// SendJSONWait is like SendJSON but blocks until the frame is queued. Only use
+// it from the connection's own goroutine, e.g. when replaying a backlog.
+func (c *Connection) SendJSONWait(message interface{}) bool {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Println("Error marshaling WebSocket message:", err)
+		return false
+	}
+	select {
+	case c.send <- data:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// Register adds c to its user's connections and reports whether it is the
+// user's first live connection
+func (h *Hub) Register(c *Connection) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	first := len(h.users[c.nickname]) == 0
+	if h.users[c.nickname] == nil {
+		h.users[c.nickname] = make(connSet)
+	}
+	h.users[c.nickname][c] = struct{}{}
+	return first
+}
+
+// Unregister removes c from its user and from every group it joined, and
+// reports whether it was the user's last live connection
+func (h *Hub) Unregister(c *Connection) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	last := false
+	if conns, ok := h.users[c.nickname]; ok {
+		if _, ok := conns[c]; ok {
+			delete(conns, c)
+			if len(conns) == 0 {
+				delete(h.users, c.nickname)
+				last = true
+			}
+		}
+	}
+	for groupID := range c.groups {
+		h.removeFromGroup(c, groupID)
+	}
+	c.groups = make(map[int]bool)
+	c.close()
+	return last
+}
+
+// removeFromGroup must be called with h.mu held
+func (h *Hub) removeFromGroup(c *Connection, groupID int) {
+	if h.groups[groupID] != nil {
+		delete(h.groups[groupID], c)
+		if len(h.groups[groupID]) == 0 {
+			delete(h.groups, groupID)
+		}
+	}
+}
+
+func (h *Hub) Subscribe(c *Connection, groupID int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c.groups[groupID] = true
+	if h.groups[groupID] == nil {
+		h.groups[groupID] = make(connSet)
+	}
+	h.groups[groupID][c] = struct{}{}
+}
+
+func (h *Hub) Unsubscribe(c *Connection, groupID int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(c.groups, groupID)
+	h.removeFromGroup(c, groupID)
+}
+
+// IsSubscribed reports whether c has joined groupID
+func (h *Hub) IsSubscribed(c *Connection, groupID int) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return c.groups[groupID]
+}
+
+// IsOnline reports whether nickname has at least one live connection
+func (h *Hub) IsOnline(nickname string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.users[nickname]) > 0
+}
+
+// userConns returns a snapshot of nickname's connections
+func (h *Hub) userConns(nickname string) []*Connection {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	conns := make([]*Connection, 0, len(h.users[nickname]))
+	for c := range h.users[nickname] {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// userIDConns returns a snapshot of the connections belonging to userID
+func (h *Hub) userIDConns(userID int) []*Connection {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var conns []*Connection
+	for _, set := range h.users {
+		for c := range set {
+			if c.userID == userID {
+				conns = append(conns, c)
+			}
+		}
+	}
+	return conns
+}
+
+// fanOut encodes message once and queues it on every connection in conns.
+// It reports whether at least one connection accepted the frame.
+func fanOut(conns []*Connection, message interface{}) bool {
+	if len(conns) == 0 {
+		return false
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Println("Error marshaling WebSocket message:", err)
+		return false
+	}
+	delivered := false
+	for _, c := range conns {
+		if c.enqueue(data) {
+			delivered = true
+		}
+	}
+	return delivered
+}
+
+// SendToUser queues message on every connection nickname holds and reports
+// whether any of them accepted it
+func (h *Hub) SendToUser(nickname string, message interface{}) bool {
+	return fanOut(h.userConns(nickname), message)
+}
+
+// SendToUserExcept queues message on nickname's connections other than skip,
+// so a user's other devices see what they sent from this one
+func (h *Hub) SendToUserExcept(nickname string, skip *Connection, message interface{}) bool {
+	var conns []*Connection
+	for _, c := range h.userConns(nickname) {
+		if c != skip {
+			conns = append(conns, c)
+		}
+	}
+	return fanOut(conns, message)
+}
+
+// SendToUserID queues message on every connection held by userID
+func (h *Hub) SendToUserID(userID int, message interface{}) bool {
+	return fanOut(h.userIDConns(userID), message)
+}
+
+// BroadcastToGroup queues message for every connection subscribed to groupID
+func (h *Hub) BroadcastToGroup(groupID int, message interface{}) {
+	h.mu.RLock()
+	targets := make([]*Connection, 0, len(h.groups[groupID]))
+	for c := range h.groups[groupID] {
+		targets = append(targets, c)
+	}
+	h.mu.RUnlock()
+
+	fanOut(targets, message)
+}
+
+// BroadcastToGroupExcept is BroadcastToGroup without skipNickname's connections
+func (h *Hub) BroadcastToGroupExcept(groupID int, skipNickname string, message interface{}) {
+	h.mu.RLock()
+	targets := make([]*Connection, 0, len(h.groups[groupID]))
+	for c := range h.groups[groupID] {
+		if c.nickname != skipNickname {
+			targets = append(targets, c)
+		}
+	}
+	h.mu.RUnlock()
+
+	fanOut(targets, message)
+}
+
+// Broadcast queues message for every live connection
+func (h *Hub) Broadcast(message interface{}) {
+	h.mu.RLock()
+	var targets []*Connection
+	for _, set := range h.users {
+		for c := range set {
+			targets = append(targets, c)
+		}
+	}
+	h.mu.RUnlock()
+
+	fanOut(targets, message)
+}
+
+// CloseSessions closes every connection opened with one of the given
+// session tokens; their read loops then run the usual cleanup
+func (h *Hub) CloseSessions(sessionIDs []string) {
+	revoked := make(map[string]bool, len(sessionIDs))
+	for _, id := range sessionIDs {
+		revoked[id] = true
+	}
+
+	h.mu.RLock()
+	var targets []*Connection
+	for _, set := range h.users {
+		for c := range set {
+			if revoked[c.session] {
+				targets = append(targets, c)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, c := range targets {
+		log.Printf("Closing connection of %s: session revoked", c.nickname)
+		c.close()
+	}
+}
+
+// ConnectionCount returns the number of users with at least one live connection
+func (h *Hub) ConnectionCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.users)
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestConnection registers a connection for nickname on h backed by a
+// real socket, and returns it with the client's end. Its writePump is not
+// started, so nothing drains its queue unless the test starts it.
+func newTestConnection(t *testing.T, h *Hub, nickname string) (*Connection, *websocket.Conn) {
+	t.Helper()
+	upgraded := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		upgraded <- ws
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	c := newConnection(h, <-upgraded, 1, nickname)
+	t.Cleanup(func() {
+		c.close()
+		c.conn.Close()
+	})
+	h.Register(c)
+	return c, client
+}
+
+func isClosed(c *Connection) bool {
+	select {
+	case <-c.done:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestHubEvictsSlowConsumer(t *testing.T) {
+	h := NewHub()
+	slow, slowClient := newTestConnection(t, h, "alice")
+	healthy, healthyClient := newTestConnection(t, h, "alice")
+	go healthy.writePump()
+
+	for i := 0; i < sendBufferSize; i++ {
+		if !slow.SendJSON(map[string]int{"n": i}) {
+			t.Fatalf("frame %d was not queued before the queue was full", i)
+		}
+	}
+
+	// The frame the slow connection has no room for evicts it, while the
+	// user's other connection still gets it
+	if !h.SendToUser("alice", map[string]string{"over": "flow"}) {
+		t.Fatal("frame was not accepted by the healthy connection")
+	}
+	if !isClosed(slow) {
+		t.Fatal("slow consumer was not evicted")
+	}
+
+	// Once its writePump runs, the evicted connection gets a normal close
+	// frame, possibly after some of the frames it had queued
+	go slow.writePump()
+	slowClient.SetReadDeadline(time.Now().Add(time.Second))
+	var err error
+	for i := 0; err == nil && i <= sendBufferSize; i++ {
+		_, _, err = slowClient.ReadMessage()
+	}
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("evicted connection ended with %v, want a normal close frame", err)
+	}
+	if slow.SendJSON(map[string]string{"after": "eviction"}) {
+		t.Fatal("evicted connection accepted a frame")
+	}
+
+	healthyClient.SetReadDeadline(time.Now().Add(time.Second))
+	if _, data, err := healthyClient.ReadMessage(); err != nil || string(data) != `{"over":"flow"}` {
+		t.Fatalf("healthy connection got %q, %v", data, err)
+	}
+	select {
+	case <-healthy.done:
+		t.Fatal("healthy connection was closed")
+	default:
+	}
+}
+
+func TestHubDropFramePolicy(t *testing.T) {
+	h := NewHub()
+	h.Policy = DropFrame
+	c, _ := newTestConnection(t, h, "bob")
+
+	for i := 0; i < sendBufferSize; i++ {
+		if !h.SendToUser("bob", map[string]int{"n": i}) {
+			t.Fatalf("frame %d was dropped before the queue was full", i)
+		}
+	}
+	if h.SendToUser("bob", map[string]string{"over": "flow"}) {
+		t.Fatal("frame was accepted by a full queue")
+	}
+	select {
+	case <-c.done:
+		t.Fatal("connection was closed under the drop policy")
+	default:
+	}
+
+	// Once the queue drains, frames are accepted again
+	<-c.send
+	if !h.SendToUser("bob", map[string]string{"after": "drain"}) {
+		t.Fatal("frame was dropped after the queue drained")
+	}
+}
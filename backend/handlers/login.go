@@ -48,7 +48,7 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create session
-	session, err := sessions.SessionStoreInstance.CreateSession(user.ID)
+	session, err := sessions.SessionStoreInstance.CreateSession(user.ID, r.UserAgent(), sessions.ClientIP(r))
 	if err != nil {
 		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"socialhub/database"
+	"strconv"
+	"time"
+)
+
+// messageEditWindow is how long after sending a message its sender may edit or unsend it
+var messageEditWindow = 15 * time.Minute
+
+// ConfigureMessageEditWindow overrides the edit/unsend window; zero keeps the default
+func ConfigureMessageEditWindow(window time.Duration) {
+	if window > 0 {
+		messageEditWindow = window
+	}
+}
+
+// Error codes for edit and unsend
+const (
+	ErrCodeMessageNotFound   = "message_not_found"
+	ErrCodeNotMessageSender  = "not_message_sender"
+	ErrCodeEditWindowExpired = "edit_window_expired"
+	ErrCodeMessageDeleted    = "message_deleted"
+)
+
+type EditMessageRequest struct {
+	MessageID int    `json:"message_id"`
+	Message   string `json:"message"`
+}
+
+type DeleteMessageRequest struct {
+	MessageID int `json:"message_id"`
+}
+
+type MessageEditedEvent struct {
+	MessageID      int    `json:"message_id"`
+	ConversationID *int   `json:"conversation_id,omitempty"`
+	From           string `json:"from"`
+	To             string `json:"to"`
+	Message        string `json:"message"`
+	EditedAt       string `json:"edited_at"`
+}
+
+type MessageDeletedEvent struct {
+	MessageID      int    `json:"message_id"`
+	ConversationID *int   `json:"conversation_id,omitempty"`
+	From           string `json:"from"`
+	To             string `json:"to"`
+	DeletedAt      string `json:"deleted_at"`
+}
+
+// editErrorCode maps database edit errors to a WebSocket error code and HTTP status
+func editErrorCode(err error) (string, int) {
+	switch err {
+	case database.ErrMessageNotFound:
+		return ErrCodeMessageNotFound, http.StatusNotFound
+	case database.ErrNotMessageSender:
+		return ErrCodeNotMessageSender, http.StatusForbidden
+	case database.ErrEditWindowExpired:
+		return ErrCodeEditWindowExpired, http.StatusForbidden
+	case database.ErrMessageAlreadyGone:
+		return ErrCodeMessageDeleted, http.StatusGone
+	default:
+		return ErrCodeInternal, http.StatusInternalServerError
+	}
+}
+
+func writeEditError(w http.ResponseWriter, action string, err error) {
+	_, status := editErrorCode(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("Error %s message: %v", action, err)
+		http.Error(w, "Internal server error", status)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// notifyParticipants pushes an event to every live connection of both sides
+// of a DM, or of everyone in a multi-party conversation
+func notifyParticipants(msg *database.Message, eventType string, data interface{}) {
+	message := WebSocketMessage{Type: eventType, Data: data}
+	if msg.Recipient == "" && msg.ConversationID != nil {
+		publishToConversation(*msg.ConversationID, message)
+		return
+	}
+	publishToUser(msg.Sender, message)
+	if msg.Recipient != msg.Sender {
+		publishToUser(msg.Recipient, message)
+	}
+}
+
+// canSeeMessage reports whether nickname is part of the conversation msg belongs to
+func canSeeMessage(msg *database.Message, nickname string) (bool, error) {
+	if msg.Sender == nickname || msg.Recipient == nickname {
+		return true, nil
+	}
+	if msg.Recipient == "" && msg.ConversationID != nil {
+		return database.IsConversationParticipant(*msg.ConversationID, nickname)
+	}
+	return false, nil
+}
+
+func editDirectMessage(sender string, req EditMessageRequest) (*database.Message, error) {
+	msg, err := database.EditMessage(req.MessageID, sender, req.Message, messageEditWindow)
+	if err != nil {
+		return nil, err
+	}
+	notifyParticipants(msg, "message_edited", MessageEditedEvent{
+		MessageID:      msg.MessageID,
+		ConversationID: msg.ConversationID,
+		From:           msg.Sender,
+		To:             msg.Recipient,
+		Message:        msg.Message,
+		EditedAt:       *msg.EditedAt,
+	})
+	return msg, nil
+}
+
+func deleteDirectMessage(sender string, req DeleteMessageRequest) (*database.Message, error) {
+	msg, files, err := database.DeleteMessage(req.MessageID, sender, messageEditWindow)
+	if err != nil {
+		return nil, err
+	}
+	removeAttachmentFiles(files)
+	notifyParticipants(msg, "message_deleted", MessageDeletedEvent{
+		MessageID:      msg.MessageID,
+		ConversationID: msg.ConversationID,
+		From:           msg.Sender,
+		To:             msg.Recipient,
+		DeletedAt:      *msg.DeletedAt,
+	})
+	return msg, nil
+}
+
+func handleEditMessage(conn *Connection, frame InboundFrame) {
+	var req EditMessageRequest
+	if !decodeFrame(conn, frame, &req) {
+		return
+	}
+	if req.MessageID == 0 || req.Message == "" {
+		sendError(conn, frame, ErrCodeInvalidMessage, "Missing message_id or message", "")
+		return
+	}
+
+	msg, err := editDirectMessage(conn.nickname, req)
+	if err != nil {
+		code, _ := editErrorCode(err)
+		if code == ErrCodeInternal {
+			log.Printf("Failed to edit message %d for %s: %v", req.MessageID, conn.nickname, err)
+		}
+		sendError(conn, frame, code, err.Error(), "")
+		return
+	}
+	sendAck(conn, frame, AckResponse{MessageID: msg.MessageID, Timestamp: *msg.EditedAt})
+}
+
+func handleDeleteMessage(conn *Connection, frame InboundFrame) {
+	var req DeleteMessageRequest
+	if !decodeFrame(conn, frame, &req) {
+		return
+	}
+	if req.MessageID == 0 {
+		sendError(conn, frame, ErrCodeInvalidMessage, "Missing message_id", "")
+		return
+	}
+
+	msg, err := deleteDirectMessage(conn.nickname, req)
+	if err != nil {
+		code, _ := editErrorCode(err)
+		if code == ErrCodeInternal {
+			log.Printf("Failed to delete message %d for %s: %v", req.MessageID, conn.nickname, err)
+		}
+		sendError(conn, frame, code, err.Error(), "")
+		return
+	}
+	sendAck(conn, frame, AckResponse{MessageID: msg.MessageID, Timestamp: *msg.DeletedAt})
+}
+
+// EditMessageHandler - POST /messages/edit {"message_id": 1, "message": "..."}
+func EditMessageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nickname, err := database.GetNickname(getUserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req EditMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.MessageID == 0 || req.Message == "" {
+		http.Error(w, "Missing message_id or message", http.StatusBadRequest)
+		return
+	}
+
+	msg, err := editDirectMessage(nickname, req)
+	if err != nil {
+		writeEditError(w, "editing", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+// DeleteMessageHandler - POST /messages/delete {"message_id": 1}
+func DeleteMessageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nickname, err := database.GetNickname(getUserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req DeleteMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.MessageID == 0 {
+		http.Error(w, "Missing message_id", http.StatusBadRequest)
+		return
+	}
+
+	msg, err := deleteDirectMessage(nickname, req)
+	if err != nil {
+		writeEditError(w, "deleting", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+// MessageEditsHandler - GET /messages/edits?message_id=1 returns a message's edit history.
+// Only the two participants of the conversation may see it.
+func MessageEditsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nickname, err := database.GetNickname(getUserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	messageID, err := strconv.Atoi(r.URL.Query().Get("message_id"))
+	if err != nil {
+		http.Error(w, "Invalid message_id", http.StatusBadRequest)
+		return
+	}
+
+	msg, err := database.GetMessageByID(messageID)
+	visible := false
+	if err == nil {
+		visible, err = canSeeMessage(msg, nickname)
+	}
+	if err == database.ErrMessageNotFound || (err == nil && !visible) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load message", http.StatusInternalServerError)
+		return
+	}
+
+	edits, err := database.GetMessageEdits(messageID)
+	if err != nil {
+		http.Error(w, "Failed to load edit history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": msg,
+		"edits":   edits,
+	})
+}
@@ -15,57 +15,6 @@ type Message struct {
 	Time time.Time `json:"time"`
 }
 
-func StoreMessageHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("Received message request: %s %s\n", r.Method, r.URL.Path) // Debug log
-
-	if r.Method != http.MethodPost {
-		fmt.Println("Invalid method:", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var message Message
-	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
-		fmt.Printf("Decoding error: %v\n", err)
-		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	fmt.Printf("Received message: %+v\n", message) // Debug log
-
-	if message.From == "" || message.To == "" || message.Text == "" {
-		fmt.Println("Missing required fields")
-		http.Error(w, "Missing required fields", http.StatusBadRequest)
-		return
-	}
-
-	query := `
-        INSERT INTO messages (sender, recipient, message, timestamp)
-        VALUES ($1, $2, $3, $4)
-    `
-	timestamp := time.Now().Format(time.RFC3339)
-
-	if _, err := database.Db.Exec(query, message.From, message.To, message.Text, timestamp); err != nil {
-		fmt.Printf("Database error: %v\n", err)
-		http.Error(w, "Failed to store message: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Get recipient's user ID for notification
-	var recipientID int
-	recipientErr := database.Db.QueryRow("SELECT uid FROM users WHERE nickname = ?", message.To).Scan(&recipientID)
-	if recipientErr != nil {
-		// Log error but don't fail the message storage
-		fmt.Printf("Warning: Failed to get recipient ID for notification: %v\n", recipientErr)
-	} else {
-		// Create notification for the recipient
-		CreateNewMessageNotification(recipientID, message.From)
-	}
-
-	fmt.Println("Message stored successfully") // Debug log
-	w.WriteHeader(http.StatusOK)
-}
-
 func GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("Method: %s | Path: %s\n", r.Method, r.URL.Path)
 
@@ -166,26 +115,39 @@ func GetUnreadMessageCountBySenderHandler(w http.ResponseWriter, r *http.Request
 	json.NewEncoder(w).Encode(counts)
 }
 
-// Handler: POST /messages/mark-read {"user": "...", "sender": "..."}
+// Handler: POST /messages/mark-read {"sender": "...", "up_to": 0}
+// The reader is always the session user; "user" in the body is ignored.
 func MarkMessagesAsReadHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r.Context())
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user, err := database.GetNickname(userID)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	type reqBody struct {
-		User   string `json:"user"`
 		Sender string `json:"sender"`
+		UpTo   int    `json:"up_to"`
 	}
 	var req reqBody
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	if req.User == "" || req.Sender == "" {
-		http.Error(w, "Missing user or sender", http.StatusBadRequest)
+	if req.Sender == "" {
+		http.Error(w, "Missing sender", http.StatusBadRequest)
 		return
 	}
-	err := database.MarkMessagesAsRead(req.User, req.Sender)
+	lastReadID, err := markConversationRead(user, req.Sender, req.UpTo)
 	if err != nil {
 		http.Error(w, "Failed to mark messages as read", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "last_read_message_id": lastReadID})
 }
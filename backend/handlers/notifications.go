@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"fmt"
+	"log"
 	"time"
 )
 
@@ -199,7 +200,7 @@ func DeleteNotificationHandler(w http.ResponseWriter, r *http.Request) {
 
 // CreateNotification - Helper function to create a notification
 func CreateNotification(userID int, notificationType string, message string, relatedID *int) error {
-	_, err := database.Db.Exec(`
+	result, err := database.Db.Exec(`
 		INSERT INTO notifications (user_id, type, message, is_read, related_id, created_at)
 		VALUES (?, ?, ?, 0, ?, ?)
 	`, userID, notificationType, message, relatedID, time.Now().Format("2006-01-02 15:04:05"))
@@ -208,11 +209,15 @@ func CreateNotification(userID int, notificationType string, message string, rel
 		fmt.Printf("Error creating notification: %v\n", err)
 		return err
 	}
+	notificationID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
 	
 	fmt.Printf("Created notification for user %d: %s - %s\n", userID, notificationType, message)
 	
 	// Also broadcast via WebSocket if user is connected
-	BroadcastNotificationToUser(userID, notificationType, message, relatedID)
+	BroadcastNotificationToUser(userID, int(notificationID), notificationType, message, relatedID)
 	
 	return nil
 }
@@ -253,6 +258,15 @@ func CreateEventCreatedNotification(groupMemberID int, groupID int, groupName st
 	return CreateNotification(groupMemberID, "event_created", message, &groupID)
 }
 
+// CreateAccountLockedNotification - Warn a user that failed logins locked their account
+func CreateAccountLockedNotification(userID int, until time.Time) {
+	message := fmt.Sprintf("Your account was locked until %s after repeated failed login attempts. If this wasn't you, reset your password.",
+		until.UTC().Format("15:04 MST"))
+	if err := CreateNotification(userID, "security_alert", message, nil); err != nil {
+		log.Printf("Failed to create lockout notification for user %d: %v", userID, err)
+	}
+}
+
 // CreatePostInteractionNotification - Create notification for likes, comments, etc.
 func CreatePostInteractionNotification(postOwnerID int, postID int, interactionType string, interactorNickname string) error {
 	var message string
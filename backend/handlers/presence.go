@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"socialhub/database"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAwayAfter is how long a connected user may send nothing before
+	// they are shown as away
+	defaultAwayAfter = 5 * time.Minute
+	// lastSeenWriteInterval throttles last_seen updates from heartbeats
+	lastSeenWriteInterval = time.Minute
+	// liveConnectionRefresh is how often an instance refreshes its connection
+	// counts; counts older than liveConnectionTTL belong to a stopped instance
+	liveConnectionRefresh = 30 * time.Second
+	liveConnectionTTL     = 3 * liveConnectionRefresh
+)
+
+// PresenceRequest is sent by clients in a "presence" frame, e.g. "away" when
+// the tab is hidden and "online" when it is shown again
+type PresenceRequest struct {
+	State string `json:"state"`
+}
+
+type presenceEntry struct {
+	state      string
+	manualAway bool
+	lastActive time.Time
+	lastWrite  time.Time
+}
+
+type presenceChange struct {
+	nickname string
+	state    string
+}
+
+// presenceTracker holds the state of every user connected to this instance.
+// Changes are made under mu and queued; a single publisher goroutine writes
+// them to online_status and pushes them to the user's followers and chat
+// partners without holding mu, in the order they happened. Whether a user is
+// online at all is decided by their connection count across instances.
+type presenceTracker struct {
+	mu        sync.Mutex
+	users     map[string]*presenceEntry
+	awayAfter time.Duration
+	pending   []presenceChange
+	wake      chan struct{}
+}
+
+var presence = &presenceTracker{
+	users:     make(map[string]*presenceEntry),
+	awayAfter: defaultAwayAfter,
+	wake:      make(chan struct{}, 1),
+}
+
+// StartPresence resets stale presence from a previous run and starts marking
+// idle users as away. Zero keeps the default idle time.
+func StartPresence(awayAfter time.Duration) {
+	if awayAfter > 0 {
+		presence.awayAfter = awayAfter
+	}
+	if err := database.ResetPresence(time.Now().Add(-liveConnectionTTL)); err != nil {
+		log.Printf("Failed to reset presence: %v", err)
+	}
+	go presence.run()
+	go presence.sweep()
+	go presence.refreshConnections()
+}
+
+// connected is called for every connection a user opens. The user comes
+// online when it is their only connection on any instance.
+func (p *presenceTracker) connected(nickname string) {
+	first, err := database.AddLiveConnection(instanceID, nickname, time.Now().Add(-liveConnectionTTL))
+	if err != nil {
+		log.Printf("Failed to count connection of %s: %v", nickname, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.users[nickname] == nil {
+		// Without a count, fall back to this instance's connections
+		first = first || err != nil
+		p.users[nickname] = &presenceEntry{state: database.PresenceOnline, lastActive: now, lastWrite: now}
+	}
+	if first {
+		p.queue(nickname, database.PresenceOnline)
+	}
+}
+
+// disconnected is called for every connection a user closes, after it left
+// the hub. It reports whether that was the user's last connection on any
+// instance, in which case they go offline.
+func (p *presenceTracker) disconnected(nickname string) bool {
+	last, err := database.RemoveLiveConnection(instanceID, nickname, time.Now().Add(-liveConnectionTTL))
+	if err != nil {
+		log.Printf("Failed to count closed connection of %s: %v", nickname, err)
+		last = !wsHub.IsOnline(nickname)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !wsHub.IsOnline(nickname) {
+		delete(p.users, nickname)
+	}
+	if last {
+		p.queue(nickname, database.PresenceOffline)
+	}
+	return last
+}
+
+// refreshConnections keeps this instance's connection counts current and
+// takes users offline whose connections were all on instances that stopped
+func (p *presenceTracker) refreshConnections() {
+	ticker := time.NewTicker(liveConnectionRefresh)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := database.RefreshLiveConnections(instanceID); err != nil {
+			log.Printf("Failed to refresh connection counts: %v", err)
+		}
+		gone, err := database.PruneLiveConnections(time.Now().Add(-liveConnectionTTL))
+		if err != nil {
+			log.Printf("Failed to prune connection counts: %v", err)
+			continue
+		}
+
+		p.mu.Lock()
+		for _, nickname := range gone {
+			p.queue(nickname, database.PresenceOffline)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// activity records a frame sent by the user; an idle user comes back online
+func (p *presenceTracker) activity(nickname string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry := p.users[nickname]
+	if entry == nil {
+		return
+	}
+	entry.lastActive = time.Now()
+	if entry.state == database.PresenceAway && !entry.manualAway {
+		entry.state = database.PresenceOnline
+		entry.lastWrite = entry.lastActive
+		p.queue(nickname, database.PresenceOnline)
+	}
+}
+
+// heartbeat keeps last_seen current for connected users. Pongs are answered
+// by the browser on its own, so they don't count as activity.
+func (p *presenceTracker) heartbeat(nickname string) {
+	p.mu.Lock()
+	entry := p.users[nickname]
+	if entry == nil || time.Since(entry.lastWrite) < lastSeenWriteInterval {
+		p.mu.Unlock()
+		return
+	}
+	entry.lastWrite = time.Now()
+	p.mu.Unlock()
+
+	if err := database.TouchLastSeen(nickname); err != nil {
+		log.Printf("Failed to update last seen for %s: %v", nickname, err)
+	}
+}
+
+// setAway applies a state the client asked for
+func (p *presenceTracker) setAway(nickname string, away bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry := p.users[nickname]
+	if entry == nil {
+		return
+	}
+	entry.manualAway = away
+	entry.lastActive = time.Now()
+
+	state := database.PresenceOnline
+	if away {
+		state = database.PresenceAway
+	}
+	if entry.state != state {
+		entry.state = state
+		entry.lastWrite = entry.lastActive
+		p.queue(nickname, state)
+	}
+}
+
+func (p *presenceTracker) sweep() {
+	ticker := time.NewTicker(p.awayAfter / 5)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.mu.Lock()
+		now := time.Now()
+		for nickname, entry := range p.users {
+			if entry.state == database.PresenceOnline && now.Sub(entry.lastActive) >= p.awayAfter {
+				entry.state = database.PresenceAway
+				entry.lastWrite = now
+				p.queue(nickname, database.PresenceAway)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// queue hands a state change to the publisher. Must be called with p.mu held.
+func (p *presenceTracker) queue(nickname, state string) {
+	p.pending = append(p.pending, presenceChange{nickname: nickname, state: state})
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run publishes queued changes one at a time, so they arrive in order
+func (p *presenceTracker) run() {
+	for range p.wake {
+		p.mu.Lock()
+		changes := p.pending
+		p.pending = nil
+		p.mu.Unlock()
+
+		for _, change := range changes {
+			p.publish(change.nickname, change.state)
+		}
+	}
+}
+
+// publish stores the new state and sends a "presence" frame to everyone in
+// the user's audience who is connected. Only run calls it.
+func (p *presenceTracker) publish(nickname, state string) {
+	if err := database.SetPresence(nickname, state); err != nil {
+		log.Printf("Failed to store presence for %s: %v", nickname, err)
+		return
+	}
+	current, err := database.GetPresence(nickname)
+	if err != nil {
+		log.Printf("Failed to load presence for %s: %v", nickname, err)
+		return
+	}
+	audience, err := database.GetPresenceAudience(nickname)
+	if err != nil {
+		log.Printf("Failed to load presence audience for %s: %v", nickname, err)
+		return
+	}
+
+	message := WebSocketMessage{Type: "presence", Data: current}
+	for _, other := range audience {
+		publishToUser(other, message)
+	}
+}
+
+func handlePresence(conn *Connection, frame InboundFrame) {
+	var req PresenceRequest
+	if !decodeFrame(conn, frame, &req) {
+		return
+	}
+	switch req.State {
+	case database.PresenceOnline:
+		presence.setAway(conn.nickname, false)
+	case database.PresenceAway:
+		presence.setAway(conn.nickname, true)
+	default:
+		sendError(conn, frame, ErrCodeInvalidMessage, "State must be online or away", "")
+		return
+	}
+	sendAck(conn, frame, AckResponse{})
+}
+
+// PresenceHandler - GET /presence?nickname=X returns the user's state and,
+// unless they hide it, when they were last seen. Only the audience that gets
+// presence pushes may ask; to everyone else the user looks unknown.
+func PresenceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := getUserIDFromContext(r.Context())
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	viewer, err := database.GetNickname(userID)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	nickname := r.URL.Query().Get("nickname")
+	if nickname == "" {
+		http.Error(w, "Missing nickname parameter", http.StatusBadRequest)
+		return
+	}
+
+	visible, err := database.CanSeePresence(viewer, nickname)
+	if err != nil {
+		log.Printf("Failed to check presence access of %s to %s: %v", viewer, nickname, err)
+		http.Error(w, "Failed to load presence", http.StatusInternalServerError)
+		return
+	}
+	if !visible {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	current, err := database.GetPresence(nickname)
+	if err == database.ErrUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load presence for %s: %v", nickname, err)
+		http.Error(w, "Failed to load presence", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(current)
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"socialhub/database"
+	"socialhub/models"
+)
+
+// PrivacySettingsHandler - GET returns the caller's privacy settings, POST updates them
+func PrivacySettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r.Context())
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req models.UpdatePrivacySettingsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := database.UpdatePrivacySettings(userID, req); err != nil {
+			log.Printf("Error updating privacy settings for user %d: %v", userID, err)
+			http.Error(w, "Failed to update privacy settings", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	settings, err := database.GetPrivacySettings(userID)
+	if err != nil {
+		log.Printf("Error loading privacy settings for user %d: %v", userID, err)
+		http.Error(w, "Failed to load privacy settings", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
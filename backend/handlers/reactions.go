@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"log"
+	"socialhub/database"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxEmojiBytes bounds a reaction; enough for flag and ZWJ sequences
+const maxEmojiBytes = 32
+
+// ReactionRequest is the data of reaction_add and reaction_remove frames.
+// GroupID is set when MessageID refers to a group chat message.
+type ReactionRequest struct {
+	MessageID int    `json:"message_id"`
+	GroupID   int    `json:"groupId,omitempty"`
+	Emoji     string `json:"emoji"`
+}
+
+// ReactionEvent is pushed as reaction_added or reaction_removed
+type ReactionEvent struct {
+	MessageID      int    `json:"message_id"`
+	GroupID        int    `json:"groupId,omitempty"`
+	ConversationID *int   `json:"conversation_id,omitempty"`
+	User           string `json:"user"`
+	Emoji          string `json:"emoji"`
+}
+
+// validEmoji accepts a short run of printable, non-space runes that contains
+// at least one non-ASCII rune, so plain words can't be used as reactions
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmojiBytes || !utf8.ValidString(emoji) {
+		return false
+	}
+	hasSymbol := false
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+		if r > unicode.MaxASCII {
+			hasSymbol = true
+		}
+	}
+	return hasSymbol
+}
+
+func handleReaction(conn *Connection, frame InboundFrame) {
+	var req ReactionRequest
+	if !decodeFrame(conn, frame, &req) {
+		return
+	}
+	req.Emoji = strings.TrimSpace(req.Emoji)
+	if req.MessageID == 0 || !validEmoji(req.Emoji) {
+		sendError(conn, frame, ErrCodeInvalidMessage, "Missing message_id or invalid emoji", "")
+		return
+	}
+
+	add := frame.Type == "reaction_add"
+	if req.GroupID != 0 {
+		reactToGroupMessage(conn, frame, req, add)
+	} else {
+		reactToDirectMessage(conn, frame, req, add)
+	}
+}
+
+// applyReaction stores or removes the reaction and reports whether anything changed
+func applyReaction(conn *Connection, frame InboundFrame, group bool, req ReactionRequest, add bool) (bool, bool) {
+	var (
+		changed bool
+		err     error
+	)
+	if add {
+		changed, err = database.AddReaction(group, req.MessageID, conn.nickname, req.Emoji)
+	} else {
+		changed, err = database.RemoveReaction(group, req.MessageID, conn.nickname, req.Emoji)
+	}
+	if err != nil {
+		log.Printf("Failed to update reaction on message %d for %s: %v", req.MessageID, conn.nickname, err)
+		sendError(conn, frame, ErrCodeInternal, "Failed to update reaction", "")
+		return false, false
+	}
+	return changed, true
+}
+
+func reactionEventType(add bool) string {
+	if add {
+		return "reaction_added"
+	}
+	return "reaction_removed"
+}
+
+func reactToDirectMessage(conn *Connection, frame InboundFrame, req ReactionRequest, add bool) {
+	msg, err := database.GetMessageByID(req.MessageID)
+	if err != nil {
+		code, _ := editErrorCode(err)
+		sendError(conn, frame, code, err.Error(), "")
+		return
+	}
+	allowed, err := canSeeMessage(msg, conn.nickname)
+	if err != nil || !allowed {
+		sendError(conn, frame, ErrCodeMessageNotFound, database.ErrMessageNotFound.Error(), "")
+		return
+	}
+	if msg.Deleted {
+		sendError(conn, frame, ErrCodeMessageDeleted, database.ErrMessageAlreadyGone.Error(), "")
+		return
+	}
+
+	changed, ok := applyReaction(conn, frame, false, req, add)
+	if !ok {
+		return
+	}
+	if changed {
+		notifyParticipants(msg, reactionEventType(add), ReactionEvent{
+			MessageID:      msg.MessageID,
+			ConversationID: msg.ConversationID,
+			User:           conn.nickname,
+			Emoji:          req.Emoji,
+		})
+	}
+	sendAck(conn, frame, AckResponse{MessageID: msg.MessageID})
+}
+
+func reactToGroupMessage(conn *Connection, frame InboundFrame, req ReactionRequest, add bool) {
+	groupID, err := database.GroupMessageGroup(req.MessageID)
+	if err != nil && err != database.ErrMessageNotFound {
+		log.Printf("Failed to load group message %d: %v", req.MessageID, err)
+		sendError(conn, frame, ErrCodeInternal, "Failed to update reaction", "")
+		return
+	}
+	if err == database.ErrMessageNotFound || groupID != req.GroupID {
+		sendError(conn, frame, ErrCodeMessageNotFound, database.ErrMessageNotFound.Error(), "")
+		return
+	}
+
+	var memberCount int
+	err = database.Db.QueryRow("SELECT COUNT(*) FROM group_members WHERE group_id = ? AND user_id = ?",
+		groupID, conn.userID).Scan(&memberCount)
+	if err != nil || memberCount == 0 {
+		sendError(conn, frame, ErrCodeNotGroupMember, "Not a member of this group", "")
+		return
+	}
+
+	changed, ok := applyReaction(conn, frame, true, req, add)
+	if !ok {
+		return
+	}
+	if changed {
+		publishToGroup(groupID, "", WebSocketMessage{Type: reactionEventType(add), Data: ReactionEvent{
+			MessageID: req.MessageID,
+			GroupID:   groupID,
+			User:      conn.nickname,
+			Emoji:     req.Emoji,
+		}})
+	}
+	sendAck(conn, frame, AckResponse{MessageID: req.MessageID})
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"log"
+	"socialhub/database"
+)
+
+// MarkReadRequest is the data of a mark_read frame: the reader has seen the
+// conversation with From, or the chat of group GroupID, up to UpTo (0 means
+// everything)
+type MarkReadRequest struct {
+	From    string `json:"from"`
+	GroupID int    `json:"groupId,omitempty"`
+	UpTo    int    `json:"up_to"`
+}
+
+// ReadReceipt is pushed to the sender's connections when their messages are read
+type ReadReceipt struct {
+	Reader            string `json:"reader"`
+	LastReadMessageID int    `json:"last_read_message_id"`
+	ReadAt            string `json:"read_at"`
+}
+
+// markConversationRead marks sender's messages to reader as read and, unless
+// the reader turned read receipts off, tells the sender in real time.
+// It returns the last message id that became read (0 if nothing changed).
+func markConversationRead(reader, sender string, upToID int) (int, error) {
+	lastReadID, readAt, err := database.MarkMessagesAsRead(reader, sender, upToID)
+	if err != nil || lastReadID == 0 {
+		return lastReadID, err
+	}
+
+	enabled, err := database.ReadReceiptsEnabled(reader)
+	if err != nil {
+		log.Printf("Failed to load read receipt setting for %s: %v", reader, err)
+		return lastReadID, nil
+	}
+	if enabled {
+		publishToUser(sender, WebSocketMessage{Type: "read_receipt", Data: ReadReceipt{
+			Reader:            reader,
+			LastReadMessageID: lastReadID,
+			ReadAt:            readAt,
+		}})
+	}
+	return lastReadID, nil
+}
+
+// GroupReadEvent is pushed to a group's subscribers when a member's read position advances
+type GroupReadEvent struct {
+	GroupID           int    `json:"groupId"`
+	Reader            string `json:"reader"`
+	LastReadMessageID int    `json:"last_read_message_id"`
+	ReadAt            string `json:"read_at"`
+}
+
+// markGroupRead advances reader's read position in groupID and, unless the
+// reader turned read receipts off, tells the group's subscribers.
+// It returns the reader's last read message id.
+func markGroupRead(groupID, userID int, reader string, upToID int) (int, error) {
+	lastReadID, readAt, err := database.MarkGroupRead(groupID, userID, upToID)
+	if err != nil || readAt == "" {
+		return lastReadID, err
+	}
+
+	enabled, err := database.ReadReceiptsEnabled(reader)
+	if err != nil {
+		log.Printf("Failed to load read receipt setting for %s: %v", reader, err)
+		return lastReadID, nil
+	}
+	if enabled {
+		publishToGroup(groupID, "", WebSocketMessage{Type: "group_read", Data: GroupReadEvent{
+			GroupID:           groupID,
+			Reader:            reader,
+			LastReadMessageID: lastReadID,
+			ReadAt:            readAt,
+		}})
+	}
+	return lastReadID, nil
+}
+
+func handleMarkRead(conn *Connection, frame InboundFrame) {
+	var req MarkReadRequest
+	if !decodeFrame(conn, frame, &req) {
+		return
+	}
+	if req.GroupID != 0 {
+		handleMarkGroupRead(conn, frame, req)
+		return
+	}
+	if req.From == "" {
+		sendError(conn, frame, ErrCodeInvalidMessage, "Missing from or groupId", "")
+		return
+	}
+
+	lastReadID, err := markConversationRead(conn.nickname, req.From, req.UpTo)
+	if err != nil {
+		log.Printf("Failed to mark messages from %s as read for %s: %v", req.From, conn.nickname, err)
+		sendError(conn, frame, ErrCodeInternal, "Failed to mark messages as read", req.From)
+		return
+	}
+	sendAck(conn, frame, AckResponse{MessageID: lastReadID})
+}
+
+func handleMarkGroupRead(conn *Connection, frame InboundFrame, req MarkReadRequest) {
+	var memberCount int
+	err := database.Db.QueryRow("SELECT COUNT(*) FROM group_members WHERE group_id = ? AND user_id = ?",
+		req.GroupID, conn.userID).Scan(&memberCount)
+	if err != nil || memberCount == 0 {
+		sendError(conn, frame, ErrCodeNotGroupMember, "Not a member of this group", "")
+		return
+	}
+
+	lastReadID, err := markGroupRead(req.GroupID, conn.userID, conn.nickname, req.UpTo)
+	if err == database.ErrMessageNotFound {
+		sendError(conn, frame, ErrCodeMessageNotFound, "Message not found in this group", "")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to mark group %d as read for %s: %v", req.GroupID, conn.nickname, err)
+		sendError(conn, frame, ErrCodeInternal, "Failed to mark messages as read", "")
+		return
+	}
+	sendAck(conn, frame, AckResponse{MessageID: lastReadID})
+}
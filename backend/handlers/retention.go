@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"socialhub/database"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultRetentionSweep is how often expired messages are looked for
+	defaultRetentionSweep = time.Minute
+	// unclaimedAttachmentTTL is how long an upload may wait to be sent
+	// before the sweeper deletes it
+	unclaimedAttachmentTTL = 24 * time.Hour
+)
+
+// RetentionRequest sets a chat's retention period; 0 keeps messages forever
+type RetentionRequest struct {
+	ChatTargetRequest
+	RetentionSeconds int `json:"retention_seconds"`
+}
+
+// MessagesExpiredEvent tells clients to drop messages the sweeper removed
+type MessagesExpiredEvent struct {
+	ConversationID int   `json:"conversation_id,omitempty"`
+	GroupID        int   `json:"groupId,omitempty"`
+	MessageIDs     []int `json:"message_ids"`
+}
+
+// StartRetentionSweeper starts deleting messages that outlived their chat's
+// retention policy and uploads that were never sent. Zero keeps the default
+// interval.
+func StartRetentionSweeper(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultRetentionSweep
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			sweepExpiredMessages()
+			sweepUnclaimedAttachments()
+		}
+	}()
+}
+
+func sweepExpiredMessages() {
+	expired, err := database.ExpireMessages(time.Now())
+	if err != nil {
+		log.Printf("Failed to expire messages: %v", err)
+	}
+	for _, batch := range expired {
+		removeAttachmentFiles(batch.Files)
+
+		event := MessagesExpiredEvent{MessageIDs: batch.MessageIDs}
+		if batch.Kind == database.ChatKindGroup {
+			event.GroupID = batch.TargetID
+			publishToGroupMembers(batch.TargetID, WebSocketMessage{Type: "messages_expired", Data: event})
+		} else {
+			event.ConversationID = batch.TargetID
+			publishToConversation(batch.TargetID, WebSocketMessage{Type: "messages_expired", Data: event})
+		}
+		log.Printf("Expired %d messages in %s %d", len(batch.MessageIDs), batch.Kind, batch.TargetID)
+	}
+}
+
+func sweepUnclaimedAttachments() {
+	files, err := database.DeleteUnclaimedAttachments(time.Now().Add(-unclaimedAttachmentTTL))
+	if err != nil {
+		log.Printf("Failed to delete unclaimed attachments: %v", err)
+		return
+	}
+	removeAttachmentFiles(files)
+	if len(files) > 0 {
+		log.Printf("Deleted %d unclaimed attachments", len(files))
+	}
+}
+
+// publishToGroupMembers sends message to every member of groupID, whether or
+// not they have the group chat open
+func publishToGroupMembers(groupID int, message interface{}) {
+	rows, err := database.Db.Query("SELECT user_id FROM group_members WHERE group_id = ?", groupID)
+	if err != nil {
+		log.Printf("Failed to get members of group %d: %v", groupID, err)
+		return
+	}
+	var members []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err == nil {
+			members = append(members, userID)
+		}
+	}
+	rows.Close()
+
+	for _, userID := range members {
+		publishToUserID(userID, message)
+	}
+}
+
+// isGroupAdmin reports whether userID administers groupID
+func isGroupAdmin(groupID, userID int) (bool, error) {
+	var isAdmin bool
+	err := database.Db.QueryRow("SELECT COALESCE(is_admin, 0) FROM group_members WHERE group_id = ? AND user_id = ?",
+		groupID, userID).Scan(&isAdmin)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return isAdmin, err
+}
+
+// RetentionHandler - GET /chat/retention?conversation_id=1 (or group_id=1)
+// shows a chat's retention policy to any of its members.
+// POST /chat/retention {"group_id": 1, "retention_seconds": 86400} changes it;
+// any participant may change a conversation's, only admins a group's.
+func RetentionHandler(w http.ResponseWriter, r *http.Request) {
+	nickname, ok := sessionNickname(w, r)
+	if !ok {
+		return
+	}
+	userID := getUserIDFromContext(r.Context())
+
+	var req RetentionRequest
+	switch r.Method {
+	case http.MethodGet:
+		req.ConversationID, _ = strconv.Atoi(r.URL.Query().Get("conversation_id"))
+		req.GroupID, _ = strconv.Atoi(r.URL.Query().Get("group_id"))
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	kind, targetID, err := chatTarget(userID, nickname, req.ChatTargetRequest)
+	if err != nil {
+		writeChatTargetError(w, err)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		policy, err := database.GetRetentionPolicy(kind, targetID)
+		if err != nil {
+			writeChatTargetError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(policy)
+		return
+	}
+
+	retention := time.Duration(req.RetentionSeconds) * time.Second
+	if retention != 0 && (retention < database.MinRetention || retention > database.MaxRetention) {
+		http.Error(w, "retention_seconds must be 0 or between "+
+			strconv.Itoa(int(database.MinRetention/time.Second))+" and "+
+			strconv.Itoa(int(database.MaxRetention/time.Second)), http.StatusBadRequest)
+		return
+	}
+	if kind == database.ChatKindGroup {
+		admin, err := isGroupAdmin(targetID, userID)
+		if err != nil || !admin {
+			http.Error(w, "Only group admins can change the retention policy", http.StatusForbidden)
+			return
+		}
+	}
+
+	policy, err := database.SetRetentionPolicy(kind, targetID, retention, nickname)
+	if err != nil {
+		writeChatTargetError(w, err)
+		return
+	}
+
+	message := WebSocketMessage{Type: "retention_updated", Data: policy}
+	if kind == database.ChatKindGroup {
+		publishToGroupMembers(targetID, message)
+	} else {
+		publishToConversation(targetID, message)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
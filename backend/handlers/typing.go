@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"log"
+	"socialhub/database"
+	"sync"
+	"time"
+)
+
+// typingTimeout is how long a typing indicator lasts without being refreshed.
+// Clients should resend typing_start while the user keeps typing.
+const typingTimeout = 6 * time.Second
+
+// TypingRequest is the data of typing_start/typing_stop frames. Exactly one
+// of To (direct chat) or GroupID (group chat) is set.
+type TypingRequest struct {
+	To      string `json:"to,omitempty"`
+	GroupID int    `json:"groupId,omitempty"`
+}
+
+// TypingEvent is relayed to the DM peer or the group's subscribers
+type TypingEvent struct {
+	From      string `json:"from"`
+	To        string `json:"to,omitempty"`
+	GroupID   int    `json:"groupId,omitempty"`
+	ExpiresIn int    `json:"expires_in,omitempty"`
+}
+
+type typingKey struct {
+	from    string
+	to      string
+	groupID int
+}
+
+// typingTracker holds one expiry timer per active indicator. Nothing here is
+// ever written to the database.
+type typingTracker struct {
+	mu     sync.Mutex
+	timers map[typingKey]*time.Timer
+}
+
+var typing = &typingTracker{timers: make(map[typingKey]*time.Timer)}
+
+// start arms or refreshes the indicator and reports whether it is new
+func (t *typingTracker) start(key typingKey) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	old, active := t.timers[key]
+	if active && old.Stop() {
+		old.Reset(typingTimeout)
+		return false
+	}
+	// Either there is no timer or its expiry is already running; a fresh
+	// timer takes over and the running expiry will see it was replaced
+	var timer *time.Timer
+	timer = time.AfterFunc(typingTimeout, func() {
+		t.expire(key, timer)
+	})
+	t.timers[key] = timer
+	return !active
+}
+
+// expire ends the indicator when timer runs out, unless start has replaced
+// timer in the meantime
+func (t *typingTracker) expire(key typingKey, timer *time.Timer) {
+	t.mu.Lock()
+	current := t.timers[key] == timer
+	if current {
+		delete(t.timers, key)
+	}
+	t.mu.Unlock()
+
+	if current {
+		relayTyping("typing_stop", key)
+	}
+}
+
+// remove drops the indicator and reports whether it was active
+func (t *typingTracker) remove(key typingKey) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	timer, ok := t.timers[key]
+	if !ok {
+		return false
+	}
+	timer.Stop()
+	delete(t.timers, key)
+	return true
+}
+
+// clear ends the indicator if it is active; sending a message does this
+func (t *typingTracker) clear(key typingKey) {
+	if t.remove(key) {
+		relayTyping("typing_stop", key)
+	}
+}
+
+// stopAll ends every indicator started by nickname, e.g. when they go offline
+func (t *typingTracker) stopAll(nickname string) {
+	t.mu.Lock()
+	var keys []typingKey
+	for key, timer := range t.timers {
+		if key.from == nickname {
+			timer.Stop()
+			delete(t.timers, key)
+			keys = append(keys, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, key := range keys {
+		relayTyping("typing_stop", key)
+	}
+}
+
+func relayTyping(eventType string, key typingKey) {
+	event := TypingEvent{From: key.from, To: key.to, GroupID: key.groupID}
+	if eventType == "typing_start" {
+		event.ExpiresIn = int(typingTimeout / time.Second)
+	}
+	message := WebSocketMessage{Type: eventType, Data: event}
+
+	if key.groupID != 0 {
+		publishToGroup(key.groupID, key.from, message)
+		return
+	}
+	publishToUser(key.to, message)
+}
+
+// handleTyping relays typing_start/typing_stop after the same access checks
+// used for sending a message to that chat
+func handleTyping(conn *Connection, frame InboundFrame) {
+	var req TypingRequest
+	if !decodeFrame(conn, frame, &req) {
+		return
+	}
+
+	key := typingKey{from: conn.nickname}
+	switch {
+	case req.GroupID != 0:
+		if !wsHub.IsSubscribed(conn, req.GroupID) {
+			sendError(conn, frame, ErrCodeNotSubscribed, "Subscribe to the group before sending typing events", "")
+			return
+		}
+		key.groupID = req.GroupID
+	case req.To != "":
+		allowed, err := database.CanMessage(conn.nickname, req.To)
+		if err == database.ErrUserNotFound {
+			sendError(conn, frame, ErrCodeUserNotFound, "Recipient does not exist", req.To)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to check chat permission %s -> %s: %v", conn.nickname, req.To, err)
+			sendError(conn, frame, ErrCodeInternal, "Could not check chat permission", req.To)
+			return
+		}
+		if !allowed {
+			sendError(conn, frame, ErrCodeChatForbidden, "You can only message public profiles or users you follow", req.To)
+			return
+		}
+		key.to = req.To
+	default:
+		sendError(conn, frame, ErrCodeInvalidMessage, "Missing to or groupId", "")
+		return
+	}
+
+	if frame.Type == "typing_start" {
+		if typing.start(key) {
+			relayTyping("typing_start", key)
+		}
+	} else {
+		typing.clear(key)
+	}
+	sendAck(conn, frame, AckResponse{})
+}
@@ -3,9 +3,12 @@ package handlers
 import (
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
 	"socialhub/database"
 	"socialhub/notify"
+	"socialhub/sessions"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -19,31 +22,16 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-type Connection struct {
-	conn     *websocket.Conn
-	userID   int
-	nickname string
-	groups   map[int]bool
-}
-
-var (
-	userConnections  = make(map[string]*Connection)
-	groupConnections = make(map[int]map[int]*Connection)
-)
-
-type WebSocketMessage struct {
-	Type string      `json:"type"`
-	Data interface{} `json:"data"`
-}
-
 type ChatMessage struct {
-	To      string `json:"to"`
-	Message string `json:"message"`
+	To          string `json:"to"`
+	Message     string `json:"message"`
+	Attachments []int  `json:"attachments,omitempty"` // ids from /chat/attachments
 }
 
 type GroupChatMessage struct {
-	GroupID int    `json:"groupId"`
-	Content string `json:"content"`
+	GroupID     int    `json:"groupId"`
+	Content     string `json:"content"`
+	Attachments []int  `json:"attachments,omitempty"`
 }
 
 type GroupSubscription struct {
@@ -51,17 +39,21 @@ type GroupSubscription struct {
 }
 
 type ChatResponse struct {
-	From      string `json:"from"`
-	To        string `json:"to"`
-	Message   string `json:"message"`
-	Timestamp string `json:"timestamp"`
+	MessageID   int                   `json:"message_id"`
+	From        string                `json:"from"`
+	To          string                `json:"to"`
+	Message     string                `json:"message"`
+	Timestamp   string                `json:"timestamp"`
+	Attachments []database.Attachment `json:"attachments,omitempty"`
 }
 
 type GroupChatResponse struct {
-	Sender    string `json:"sender"`
-	Content   string `json:"content"`
-	Timestamp string `json:"timestamp"`
-	GroupID   int    `json:"groupId"`
+	MessageID   int                   `json:"message_id"`
+	Sender      string                `json:"sender"`
+	Content     string                `json:"content"`
+	Timestamp   string                `json:"timestamp"`
+	GroupID     int                   `json:"groupId"`
+	Attachments []database.Attachment `json:"attachments,omitempty"`
 }
 
 var notifyFollowStatusUpdateFunc func(string, string)
@@ -79,12 +71,13 @@ func UnifiedWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sessionID := userCookie.Value
-	userID, err := database.GetUserIDBySession(sessionID)
+	session, err := sessions.SessionStoreInstance.Validate(sessionID)
 	if err != nil {
 		log.Println("Invalid session:", err)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	userID := session.UserID
 
 	nickname, err := database.GetNickname(userID)
 	if err != nil {
@@ -92,102 +85,169 @@ func UnifiedWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 		nickname = "Guest"
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	protocol := negotiateProtocol(r)
+	conn, err := upgrader.Upgrade(w, r, protocolResponseHeader(r, protocol))
 	if err != nil {
 		log.Println("Error upgrading to WebSocket:", err)
 		return
 	}
 	defer conn.Close()
 
-	connection := &Connection{
-		conn:     conn,
-		userID:   userID,
-		nickname: nickname,
-		groups:   make(map[int]bool),
-	}
-
-	userConnections[nickname] = connection
-	log.Printf("User %s connected via unified WebSocket", nickname)
-
-	pendingMessages, err := database.GetMessagesForUser(nickname)
-	if err != nil {
-		log.Println("Error fetching pending messages:", err)
-	} else {
-		for _, msg := range pendingMessages {
-			response := ChatResponse{
-				From:      msg.Sender,
-				To:        nickname,
-				Message:   msg.Message,
-				Timestamp: msg.Timestamp,
-			}
-			conn.WriteJSON(WebSocketMessage{Type: "chat", Data: response})
+	connection := newConnection(wsHub, conn, userID, nickname)
+	connection.session = sessionID
+	connection.protocol = protocol
+	wsHub.Register(connection)
+	connection.startHeartbeat()
+	go connection.writePump()
+	log.Printf("User %s connected via unified WebSocket (protocol v%d)", nickname, protocol)
+
+	if protocol >= ProtocolV2 {
+		connection.SendJSON(WebSocketMessage{Type: "hello", Data: HelloResponse{
+			Protocol:          protocol,
+			SupportedVersions: supportedProtocolVersions(),
+			Nickname:          nickname,
+		}})
+	}
+
+	// Other devices of the same user, on any instance, don't change presence
+	presence.connected(nickname)
+
+	// Clients that track message ids pass ?resume_from=<last message_id> and
+	// get exactly what they missed; older clients get undelivered messages only
+	if resumeFrom := r.URL.Query().Get("resume_from"); resumeFrom != "" {
+		afterID, err := strconv.Atoi(resumeFrom)
+		if err != nil {
+			log.Printf("Invalid resume_from %q from %s, replaying undelivered messages", resumeFrom, nickname)
+			connection.replayMissedMessages(false, 0)
+		} else {
+			connection.replayMissedMessages(true, afterID)
 		}
+	} else {
+		connection.replayMissedMessages(false, 0)
 	}
 
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				log.Printf("No pong from %s within %s, reaping stale connection", nickname, wsHub.PongWait)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Println("Unexpected WebSocket error:", err)
 			}
 			break
 		}
+		connection.extendReadDeadline()
 
-		var wsMsg WebSocketMessage
-		if err := json.Unmarshal(message, &wsMsg); err != nil {
+		var frame InboundFrame
+		if err := json.Unmarshal(message, &frame); err != nil {
 			log.Println("Error parsing message:", err)
+			sendError(connection, frame, ErrCodeInvalidMessage, "Frame is not valid JSON", "")
 			continue
 		}
 
-		switch wsMsg.Type {
+		if frame.Version > CurrentProtocolVersion {
+			sendError(connection, frame, ErrCodeUnsupportedVersion,
+				"Protocol version "+strconv.Itoa(frame.Version)+" is not supported", "")
+			continue
+		}
+
+		// Acks, resumes and presence frames are sent by the client on its own
+		if frame.Type != "ack" && frame.Type != "resume" && frame.Type != "presence" {
+			presence.activity(nickname)
+		}
+
+		switch frame.Type {
 		case "chat":
-			handlePrivateChat(connection, wsMsg.Data)
+			handlePrivateChat(connection, frame)
 		case "group_subscribe", "subscribe":
-			handleGroupSubscription(connection, wsMsg.Data)
+			handleGroupSubscription(connection, frame)
 		case "group_unsubscribe", "unsubscribe":
-			handleGroupUnsubscription(connection, wsMsg.Data)
+			handleGroupUnsubscription(connection, frame)
 		case "group_chat":
-			handleGroupChat(connection, wsMsg.Data)
+			handleGroupChat(connection, frame)
+		case "conversation_message":
+			handleConversationMessage(connection, frame)
+		case "resume":
+			handleResume(connection, frame)
+		case "ack":
+			handleAck(connection, frame)
+		case "edit_message":
+			handleEditMessage(connection, frame)
+		case "delete_message":
+			handleDeleteMessage(connection, frame)
+		case "reaction_add", "reaction_remove":
+			handleReaction(connection, frame)
+		case "mark_read":
+			handleMarkRead(connection, frame)
+		case "typing_start", "typing_stop":
+			handleTyping(connection, frame)
+		case "presence":
+			handlePresence(connection, frame)
 		default:
-			log.Printf("Unknown message type: %s", wsMsg.Type)
+			log.Printf("Unknown message type: %s", frame.Type)
+			sendError(connection, frame, ErrCodeUnknownType, "Unknown message type: "+frame.Type, "")
 		}
 	}
 
 	cleanup(connection)
 }
 
-func handlePrivateChat(conn *Connection, data interface{}) {
-	rawData, err := json.Marshal(data)
-	if err != nil {
-		log.Println("Error marshaling chat data:", err)
+func handlePrivateChat(conn *Connection, frame InboundFrame) {
+	var chatMsg ChatMessage
+	if !decodeFrame(conn, frame, &chatMsg) {
 		return
 	}
 
-	var chatMsg ChatMessage
-	if err := json.Unmarshal(rawData, &chatMsg); err != nil {
-		log.Println("Error parsing chat message:", err)
+	if chatMsg.To == "" || (chatMsg.Message == "" && len(chatMsg.Attachments) == 0) {
+		sendError(conn, frame, ErrCodeInvalidMessage, "Missing recipient or message", chatMsg.To)
+		return
+	}
+
+	allowed, err := database.CanMessage(conn.nickname, chatMsg.To)
+	if err == database.ErrUserNotFound {
+		sendError(conn, frame, ErrCodeUserNotFound, "Recipient does not exist", chatMsg.To)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to check chat permission %s -> %s: %v", conn.nickname, chatMsg.To, err)
+		sendError(conn, frame, ErrCodeInternal, "Could not check chat permission", chatMsg.To)
+		return
+	}
+	if !allowed {
+		log.Printf("User %s is not allowed to message %s", conn.nickname, chatMsg.To)
+		sendError(conn, frame, ErrCodeChatForbidden, "You can only message public profiles or users you follow", chatMsg.To)
+		return
+	}
+	if !checkFrameAttachments(conn, frame, chatMsg.Attachments, chatMsg.To) {
 		return
 	}
 
 	timestamp := database.GetCurrentTimestamp()
 
-	err = database.SaveMessage(chatMsg.To, conn.nickname, chatMsg.Message, timestamp)
+	messageID, attachments, err := database.SaveMessage(chatMsg.To, conn.nickname, chatMsg.Message, timestamp, chatMsg.Attachments)
+	if err == database.ErrAttachmentNotUsable {
+		sendError(conn, frame, ErrCodeAttachmentInvalid, err.Error(), chatMsg.To)
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to save message: %v", err)
+		sendError(conn, frame, ErrCodeInternal, "Failed to save message", chatMsg.To)
 		return
 	}
 
-	if recipientConn, ok := userConnections[chatMsg.To]; ok {
-		response := ChatResponse{
-			From:      conn.nickname,
-			To:        chatMsg.To,
-			Message:   chatMsg.Message,
-			Timestamp: timestamp,
-		}
-		err := recipientConn.conn.WriteJSON(WebSocketMessage{Type: "chat", Data: response})
-		if err != nil {
-			log.Printf("Error sending message to %s: %v", chatMsg.To, err)
-		}
+	response := ChatResponse{
+		MessageID:   messageID,
+		From:        conn.nickname,
+		To:          chatMsg.To,
+		Message:     chatMsg.Message,
+		Timestamp:   timestamp,
+		Attachments: attachments,
+	}
+	publishChat(chatMsg.To, response)
+	typing.clear(typingKey{from: conn.nickname, to: chatMsg.To})
+	sendAck(conn, frame, AckResponse{MessageID: messageID, Timestamp: timestamp})
+	if chatMsg.To != conn.nickname {
+		publishToOtherDevices(conn, WebSocketMessage{Type: "chat", Data: response})
 	}
 
 	// Create notification for the recipient
@@ -197,91 +257,74 @@ func handlePrivateChat(conn *Connection, data interface{}) {
 	if err != nil {
 		log.Printf("Warning: Failed to get recipient ID for notification: %v", err)
 	} else {
-		// Create notification for the recipient
-		CreateNewMessageNotification(recipientID, conn.nickname)
+		// Create notification for the recipient unless they muted this chat
+		notifyDirectMessage(recipientID, conn.nickname, chatMsg.To)
 	}
 }
 
-func handleGroupSubscription(conn *Connection, data interface{}) {
-	rawData, err := json.Marshal(data)
-	if err != nil {
-		log.Println("Error marshaling subscription data:", err)
-		return
-	}
-
+func handleGroupSubscription(conn *Connection, frame InboundFrame) {
 	var sub GroupSubscription
-	if err := json.Unmarshal(rawData, &sub); err != nil {
-		log.Println("Error parsing group subscription:", err)
+	if !decodeFrame(conn, frame, &sub) {
 		return
 	}
 
 	var memberCount int
-	err = database.Db.QueryRow("SELECT COUNT(*) FROM group_members WHERE group_id = ? AND user_id = ?",
+	err := database.Db.QueryRow("SELECT COUNT(*) FROM group_members WHERE group_id = ? AND user_id = ?",
 		sub.GroupID, conn.userID).Scan(&memberCount)
 	if err != nil || memberCount == 0 {
 		log.Printf("User %s not authorized for group %d", conn.nickname, sub.GroupID)
+		sendError(conn, frame, ErrCodeNotGroupMember, "Not a member of this group", "")
 		return
 	}
 
-	conn.groups[sub.GroupID] = true
-
-	if groupConnections[sub.GroupID] == nil {
-		groupConnections[sub.GroupID] = make(map[int]*Connection)
-	}
-	groupConnections[sub.GroupID][conn.userID] = conn
+	wsHub.Subscribe(conn, sub.GroupID)
+	sendAck(conn, frame, AckResponse{})
 
 	log.Printf("User %s subscribed to group %d", conn.nickname, sub.GroupID)
 }
 
-func handleGroupUnsubscription(conn *Connection, data interface{}) {
-	rawData, err := json.Marshal(data)
-	if err != nil {
-		log.Println("Error marshaling unsubscription data:", err)
-		return
-	}
-
+func handleGroupUnsubscription(conn *Connection, frame InboundFrame) {
 	var sub GroupSubscription
-	if err := json.Unmarshal(rawData, &sub); err != nil {
-		log.Println("Error parsing group unsubscription:", err)
+	if !decodeFrame(conn, frame, &sub) {
 		return
 	}
 
-	delete(conn.groups, sub.GroupID)
-	if groupConnections[sub.GroupID] != nil {
-		delete(groupConnections[sub.GroupID], conn.userID)
-		if len(groupConnections[sub.GroupID]) == 0 {
-			delete(groupConnections, sub.GroupID)
-		}
-	}
+	wsHub.Unsubscribe(conn, sub.GroupID)
+	sendAck(conn, frame, AckResponse{})
 
 	log.Printf("User %s unsubscribed from group %d", conn.nickname, sub.GroupID)
 }
 
-func handleGroupChat(conn *Connection, data interface{}) {
-	rawData, err := json.Marshal(data)
-	if err != nil {
-		log.Println("Error marshaling group chat data:", err)
+func handleGroupChat(conn *Connection, frame InboundFrame) {
+	var groupMsg GroupChatMessage
+	if !decodeFrame(conn, frame, &groupMsg) {
 		return
 	}
 
-	var groupMsg GroupChatMessage
-	if err := json.Unmarshal(rawData, &groupMsg); err != nil {
-		log.Println("Error parsing group chat message:", err)
+	if !wsHub.IsSubscribed(conn, groupMsg.GroupID) {
+		log.Printf("User %s not subscribed to group %d", conn.nickname, groupMsg.GroupID)
+		sendError(conn, frame, ErrCodeNotSubscribed, "Subscribe to the group before sending messages", "")
 		return
 	}
 
-	if !conn.groups[groupMsg.GroupID] {
-		log.Printf("User %s not subscribed to group %d", conn.nickname, groupMsg.GroupID)
+	if groupMsg.Content == "" && len(groupMsg.Attachments) == 0 {
+		sendError(conn, frame, ErrCodeInvalidMessage, "Missing content", "")
+		return
+	}
+	if !checkFrameAttachments(conn, frame, groupMsg.Attachments, "") {
 		return
 	}
 
 	timestamp := time.Now()
-	_, err = database.Db.Exec(
-		"INSERT INTO group_messages (group_id, user_id, message, created_at) VALUES (?, ?, ?, ?)",
-		groupMsg.GroupID, conn.userID, groupMsg.Content, timestamp,
-	)
+	messageID, attachments, err := database.SaveGroupMessage(groupMsg.GroupID, conn.userID, conn.nickname,
+		groupMsg.Content, timestamp, groupMsg.Attachments)
+	if err == database.ErrAttachmentNotUsable {
+		sendError(conn, frame, ErrCodeAttachmentInvalid, err.Error(), "")
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to save group message: %v", err)
+		sendError(conn, frame, ErrCodeInternal, "Failed to save group message", "")
 		return
 	}
 
@@ -291,13 +334,17 @@ func handleGroupChat(conn *Connection, data interface{}) {
 	}
 
 	response := GroupChatResponse{
-		Sender:    conn.nickname,
-		Content:   groupMsg.Content,
-		Timestamp: timestamp.Format(time.RFC3339),
-		GroupID:   groupMsg.GroupID,
+		MessageID:   messageID,
+		Sender:      conn.nickname,
+		Content:     groupMsg.Content,
+		Timestamp:   timestamp.Format(time.RFC3339),
+		GroupID:     groupMsg.GroupID,
+		Attachments: attachments,
 	}
 
 	broadcastToGroup(groupMsg.GroupID, response)
+	typing.clear(typingKey{from: conn.nickname, groupID: groupMsg.GroupID})
+	sendAck(conn, frame, AckResponse{MessageID: messageID, Timestamp: response.Timestamp})
 
 	// Get group name for notifications
 	var groupName string
@@ -319,68 +366,45 @@ func handleGroupChat(conn *Connection, data interface{}) {
 			if err := rows.Scan(&memberID); err != nil {
 				continue
 			}
-			// Create notification for each group member
-			CreateGroupMessageNotification(memberID, groupMsg.GroupID, groupName, conn.nickname)
+			// Create notification for each group member who hasn't muted the group
+			if !chatMuted(memberID, database.ChatKindGroup, groupMsg.GroupID) {
+				CreateGroupMessageNotification(memberID, groupMsg.GroupID, groupName, conn.nickname)
+			}
 		}
 	}
 }
 
 func broadcastToGroup(groupID int, message GroupChatResponse) {
-	if groupConns, exists := groupConnections[groupID]; exists {
-		for userID, conn := range groupConns {
-			err := conn.conn.WriteJSON(WebSocketMessage{Type: "group_chat", Data: message})
-			if err != nil {
-				log.Printf("Failed to send group message to user %d: %v", userID, err)
-				conn.conn.Close()
-				delete(groupConns, userID)
-			}
-		}
-	}
+	publishToGroup(groupID, "", WebSocketMessage{Type: "group_chat", Data: message})
 }
 
 func cleanup(conn *Connection) {
-	delete(userConnections, conn.nickname)
-
-	for groupID := range conn.groups {
-		if groupConnections[groupID] != nil {
-			delete(groupConnections[groupID], conn.userID)
-			if len(groupConnections[groupID]) == 0 {
-				delete(groupConnections, groupID)
-			}
-		}
-	}
+	wsHub.Unregister(conn)
 
 	log.Printf("User %s disconnected and cleaned up", conn.nickname)
+
+	// Only go offline once the user's last device on any instance has disconnected
+	if presence.disconnected(conn.nickname) {
+		typing.stopAll(conn.nickname)
+	}
 }
 
 func NotifyFollowStatusUpdate(nickname string, status string) {
 	log.Printf("Notifying %s about follow status update: %s", nickname, status)
-	if conn, ok := userConnections[nickname]; ok {
-		message := WebSocketMessage{
-			Type: "follow_status_update",
-			Data: map[string]string{"status": status},
-		}
-		err := conn.conn.WriteJSON(message)
-		if err != nil {
-			log.Printf("Error sending follow status update to %s: %v", nickname, err)
-			delete(userConnections, nickname)
-		}
+	message := WebSocketMessage{
+		Type: "follow_status_update",
+		Data: map[string]string{"status": status},
 	}
+	publishToUser(nickname, message)
 }
 
 func BroadcastUserListUpdate() {
-	log.Printf("Broadcasting user list update to %d connected clients", len(userConnections))
+	log.Printf("Broadcasting user list update to %d connected clients", wsHub.ConnectionCount())
 	message := WebSocketMessage{
 		Type: "user_list_update",
 		Data: nil,
 	}
-	for nickname, conn := range userConnections {
-		err := conn.conn.WriteJSON(message)
-		if err != nil {
-			log.Printf("Error broadcasting to %s: %v", nickname, err)
-			delete(userConnections, nickname)
-		}
-	}
+	publishToAll(message)
 }
 
 // BroadcastNotificationUpdate sends real-time notification updates to all users in a group
@@ -401,6 +425,9 @@ func BroadcastNotificationUpdate(groupID int, senderID int) {
 		if err := rows.Scan(&userID); err != nil {
 			continue
 		}
+		if chatMuted(userID, database.ChatKindGroup, groupID) {
+			continue
+		}
 
 		// Get user's nickname
 		var nickname string
@@ -411,20 +438,14 @@ func BroadcastNotificationUpdate(groupID int, senderID int) {
 		}
 
 		// Send notification update to the user
-		if conn, ok := userConnections[nickname]; ok {
-			message := WebSocketMessage{
-				Type: "notification_update",
-				Data: map[string]interface{}{
-					"group_id": groupID,
-					"action":   "new_message",
-				},
-			}
-			err := conn.conn.WriteJSON(message)
-			if err != nil {
-				log.Printf("Error sending notification update to %s: %v", nickname, err)
-				delete(userConnections, nickname)
-			}
+		message := WebSocketMessage{
+			Type: "notification_update",
+			Data: map[string]interface{}{
+				"group_id": groupID,
+				"action":   "new_message",
+			},
 		}
+		publishToUser(nickname, message)
 	}
 }
 
@@ -456,39 +477,27 @@ func BroadcastEventNotificationUpdate(eventID int, groupID int, creatorID int) {
 		}
 
 		// Send event notification update to the user
-		if conn, ok := userConnections[nickname]; ok {
-			message := WebSocketMessage{
-				Type: "event_notification_update",
-				Data: map[string]interface{}{
-					"event_id": eventID,
-					"group_id": groupID,
-					"action":   "new_event",
-				},
-			}
-			err := conn.conn.WriteJSON(message)
-			if err != nil {
-				log.Printf("Error sending event notification update to %s: %v", nickname, err)
-				delete(userConnections, nickname)
-			}
+		message := WebSocketMessage{
+			Type: "event_notification_update",
+			Data: map[string]interface{}{
+				"event_id": eventID,
+				"group_id": groupID,
+				"action":   "new_event",
+			},
 		}
+		publishToUser(nickname, message)
 	}
 }
 
 // BroadcastRequestUpdate sends real-time request updates to a specific user
 func BroadcastRequestUpdate(nickname string, requestType string) {
-	if conn, ok := userConnections[nickname]; ok {
-		message := WebSocketMessage{
-			Type: requestType,
-			Data: map[string]interface{}{
-				"action": "new_request",
-			},
-		}
-		err := conn.conn.WriteJSON(message)
-		if err != nil {
-			log.Printf("Error sending request update to %s: %v", nickname, err)
-			delete(userConnections, nickname)
-		}
+	message := WebSocketMessage{
+		Type: requestType,
+		Data: map[string]interface{}{
+			"action": "new_request",
+		},
 	}
+	publishToUser(nickname, message)
 }
 
 func InitializeWebSocketNotifications() {
@@ -499,24 +508,12 @@ func InitializeWebSocketNotifications() {
 }
 
 // BroadcastNotificationToUser - Send notification to a specific user via WebSocket
-func BroadcastNotificationToUser(userID int, notificationType string, message string, relatedID *int) {
-	// Find the user's connection
-	var userConn *Connection
-	for _, conn := range userConnections {
-		if conn.userID == userID {
-			userConn = conn
-			break
-		}
-	}
-
-	if userConn == nil {
-		// User is not connected, notification will be stored in database
-		return
-	}
-
+// and the /events stream. notificationID is the row in the notifications table.
+func BroadcastNotificationToUser(userID int, notificationID int, notificationType string, message string, relatedID *int) {
 	notificationMessage := WebSocketMessage{
 		Type: "notification",
 		Data: map[string]interface{}{
+			"id":         notificationID,
 			"type":       notificationType,
 			"message":    message,
 			"related_id": relatedID,
@@ -524,13 +521,6 @@ func BroadcastNotificationToUser(userID int, notificationType string, message st
 		},
 	}
 
-	messageJSON, err := json.Marshal(notificationMessage)
-	if err != nil {
-		log.Println("Error marshaling notification message:", err)
-		return
-	}
-
-	if err := userConn.conn.WriteMessage(websocket.TextMessage, messageJSON); err != nil {
-		log.Println("Error sending notification:", err)
-	}
+	// If the user is not connected the notification is still stored in the database
+	route(busFrame{Kind: routeUserID, UserID: userID, EventID: notificationID}, notificationMessage)
 }
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Protocol versions spoken on /ws. Version 1 is the original untyped
+// protocol: frames have no request id and the server never acks. Version 2
+// adds request ids, "ack" replies and the "hello" frame sent on connect.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+
+	CurrentProtocolVersion = ProtocolV2
+	minProtocolVersion     = ProtocolV1
+
+	subprotocolPrefix = "socialhub.v"
+)
+
+// Error codes carried in ErrorResponse.Code
+const (
+	ErrCodeInvalidMessage     = "invalid_message"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeUserNotFound       = "user_not_found"
+	ErrCodeChatForbidden      = "chat_forbidden"
+	ErrCodeNotGroupMember     = "not_group_member"
+	ErrCodeNotSubscribed      = "not_subscribed"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeInternal           = "internal_error"
+)
+
+// WebSocketMessage is the envelope for every frame the server sends
+type WebSocketMessage struct {
+	Type      string      `json:"type"`
+	RequestID string      `json:"request_id,omitempty"`
+	Data      interface{} `json:"data"`
+}
+
+// InboundFrame is the envelope for frames sent by clients. Data stays raw
+// until the handler for Type decodes it into its own struct.
+type InboundFrame struct {
+	Type      string          `json:"type"`
+	Version   int             `json:"v,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// HelloResponse is the first frame a version 2 client receives
+type HelloResponse struct {
+	Protocol          int    `json:"protocol"`
+	SupportedVersions []int  `json:"supported_versions"`
+	Nickname          string `json:"nickname"`
+}
+
+// AckResponse confirms that a client frame was processed. For stored
+// messages it carries the id and timestamp the server assigned.
+type AckResponse struct {
+	For       string `json:"for"`
+	MessageID int    `json:"message_id,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+}
+
+// ErrorResponse is sent in an "error" frame when the server refuses a client frame
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	For     string `json:"for,omitempty"`
+	To      string `json:"to,omitempty"`
+}
+
+// negotiateProtocol picks the protocol version for a new connection. Clients
+// ask for one with the "socialhub.v<N>" subprotocol or the v query parameter;
+// anything else is treated as a version 1 client. A request for a newer
+// version than the server knows is answered with the newest it supports.
+func negotiateProtocol(r *http.Request) int {
+	requested := 0
+	for _, proto := range websocketSubprotocols(r) {
+		if !strings.HasPrefix(proto, subprotocolPrefix) {
+			continue
+		}
+		if v, err := strconv.Atoi(strings.TrimPrefix(proto, subprotocolPrefix)); err == nil && v > requested {
+			requested = v
+		}
+	}
+	if requested == 0 {
+		if v, err := strconv.Atoi(r.URL.Query().Get("v")); err == nil {
+			requested = v
+		}
+	}
+
+	switch {
+	case requested < minProtocolVersion:
+		return ProtocolV1
+	case requested > CurrentProtocolVersion:
+		return CurrentProtocolVersion
+	default:
+		return requested
+	}
+}
+
+func websocketSubprotocols(r *http.Request) []string {
+	var protos []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, proto := range strings.Split(header, ",") {
+			if proto = strings.TrimSpace(proto); proto != "" {
+				protos = append(protos, proto)
+			}
+		}
+	}
+	return protos
+}
+
+// protocolResponseHeader echoes the negotiated subprotocol if the client offered it
+func protocolResponseHeader(r *http.Request, version int) http.Header {
+	want := subprotocolPrefix + strconv.Itoa(version)
+	for _, proto := range websocketSubprotocols(r) {
+		if proto == want {
+			return http.Header{"Sec-WebSocket-Protocol": {want}}
+		}
+	}
+	return nil
+}
+
+func supportedProtocolVersions() []int {
+	versions := make([]int, 0, CurrentProtocolVersion-minProtocolVersion+1)
+	for v := minProtocolVersion; v <= CurrentProtocolVersion; v++ {
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// decodeFrame unmarshals frame.Data into v and answers with an
+// invalid_message error when it doesn't fit
+func decodeFrame(conn *Connection, frame InboundFrame, v interface{}) bool {
+	if len(frame.Data) == 0 {
+		sendError(conn, frame, ErrCodeInvalidMessage, "Missing data", "")
+		return false
+	}
+	if err := json.Unmarshal(frame.Data, v); err != nil {
+		sendError(conn, frame, ErrCodeInvalidMessage, "Malformed "+frame.Type+" frame: "+err.Error(), "")
+		return false
+	}
+	return true
+}
+
+// sendAck confirms frame to clients that speak version 2 or later. Version 1
+// clients never expected replies, so they don't get any.
+func sendAck(conn *Connection, frame InboundFrame, ack AckResponse) {
+	if conn.protocol < ProtocolV2 {
+		return
+	}
+	ack.For = frame.Type
+	conn.SendJSON(WebSocketMessage{Type: "ack", RequestID: frame.RequestID, Data: ack})
+}
+
+func sendError(conn *Connection, frame InboundFrame, code, message, to string) {
+	conn.SendJSON(WebSocketMessage{
+		Type:      "error",
+		RequestID: frame.RequestID,
+		Data:      ErrorResponse{Code: code, Message: message, For: frame.Type, To: to},
+	})
+}
@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"socialhub/database"
 	"socialhub/followers"
 	"socialhub/handlers"
+	"socialhub/pubsub"
 	"socialhub/sessions"
+	"time"
 )
 
 func main() {
@@ -15,19 +18,65 @@ func main() {
 
 	ss := sessions.CreateSessionStore(database.Db)
 	sessions.SessionStoreInstance = ss
+	ss.OnRevoke = handlers.CloseRevokedSessions
+	ss.IdleTimeout = envDuration("SESSION_IDLE_TIMEOUT")
+	ss.MaxLifetime = envDuration("SESSION_MAX_LIFETIME")
+	ss.StartReaper(envDuration("SESSION_REAP_INTERVAL"))
 	followers.Db = database.Db
 
+	handlers.ConfigureHeartbeat(
+		envDuration("WS_PING_INTERVAL"),
+		envDuration("WS_PONG_TIMEOUT"),
+		envDuration("WS_WRITE_TIMEOUT"),
+	)
+	// With PUBSUB_URL=redis://host:6379 several instances share real-time delivery
+	var broker pubsub.Broker = pubsub.NewLocal()
+	if pubsubURL := os.Getenv("PUBSUB_URL"); pubsubURL != "" {
+		redis, err := pubsub.NewRedis(pubsubURL)
+		if err != nil {
+			log.Fatalf("Failed to connect to pub/sub broker: %v", err)
+		}
+		broker = redis
+		log.Println("Routing WebSocket broadcasts through Redis pub/sub")
+	}
+	if err := handlers.StartBus(broker); err != nil {
+		log.Fatalf("Failed to subscribe to pub/sub broker: %v", err)
+	}
+	if err := handlers.CreateAttachmentDir(); err != nil {
+		log.Printf("Error creating attachments directory: %v", err)
+	}
+	handlers.ConfigureMessageEditWindow(envDuration("MESSAGE_EDIT_WINDOW"))
+	handlers.StartPresence(envDuration("PRESENCE_AWAY_AFTER"))
+	handlers.StartRetentionSweeper(envDuration("RETENTION_SWEEP_INTERVAL"))
 	handlers.InitializeWebSocketNotifications()
 	followers.SetNotifyFollowStatusUpdate(handlers.NotifyFollowStatusUpdate)
 
-	Auth := sessions.AuthHandler{SessionStore: ss, DB: database.Db}
+	Auth := sessions.AuthHandler{
+		SessionStore:  ss,
+		DB:            database.Db,
+		Mailer:        newMailer(),
+		ResetURL:      envString("PASSWORD_RESET_URL", "http://localhost:3000/reset-password"),
+		ResetTokenTTL: envDuration("PASSWORD_RESET_TTL"),
+		OnLockout:     handlers.CreateAccountLockedNotification,
+	}
 
 	http.HandleFunc("/ws", handlers.UnifiedWebSocketHandler)
+	http.HandleFunc("/events", corsMiddleware(Auth.RequireAuth(handlers.EventsHandler)))
 
 	http.HandleFunc("/login", corsMiddleware(Auth.Login))
 	http.HandleFunc("/register", corsMiddleware(handlers.RegHandler))
 	http.HandleFunc("/logout", corsMiddleware(Auth.Logout))
 	http.HandleFunc("/auth/status", corsMiddleware(Auth.AuthStatus))
+	http.HandleFunc("/sessions", corsMiddleware(Auth.RequireAuth(Auth.ListSessions)))
+	http.HandleFunc("/sessions/revoke", corsMiddleware(Auth.RequireAuth(Auth.RevokeSession)))
+	http.HandleFunc("/sessions/revoke-others", corsMiddleware(Auth.RequireAuth(Auth.RevokeOtherSessions)))
+	http.HandleFunc("/login/2fa", corsMiddleware(Auth.LoginTwoFactor))
+	http.HandleFunc("/2fa", corsMiddleware(Auth.RequireAuth(Auth.TwoFactorStatus)))
+	http.HandleFunc("/2fa/enroll", corsMiddleware(Auth.RequireAuth(Auth.EnrollTwoFactor)))
+	http.HandleFunc("/2fa/confirm", corsMiddleware(Auth.RequireAuth(Auth.ConfirmTwoFactor)))
+	http.HandleFunc("/2fa/disable", corsMiddleware(Auth.RequireAuth(Auth.DisableTwoFactor)))
+	http.HandleFunc("/password-reset/request", corsMiddleware(Auth.RequestPasswordReset))
+	http.HandleFunc("/password-reset/confirm", corsMiddleware(Auth.ConfirmPasswordReset))
 
 	http.HandleFunc("/createpost", corsMiddleware(handlers.InsertPostHandler))
 	http.HandleFunc("/posts", corsMiddleware(handlers.GetPostsHandler))
@@ -68,10 +117,16 @@ func main() {
 
 	http.HandleFunc("/all-nicknames", corsMiddleware(handlers.GetAllNicknamesHandler))
 	http.HandleFunc("/messages", corsMiddleware(handlers.GetMessagesHandler))
-	http.HandleFunc("/messages/store", corsMiddleware(handlers.StoreMessageHandler))
 	http.HandleFunc("/messages/unread/count", corsMiddleware(handlers.GetUnreadMessageCountHandler))
 	http.HandleFunc("/messages/unread/by-sender", corsMiddleware(handlers.GetUnreadMessageCountBySenderHandler))
-	http.HandleFunc("/messages/mark-read", corsMiddleware(handlers.MarkMessagesAsReadHandler))
+	http.HandleFunc("/messages/mark-read", corsMiddleware(Auth.RequireAuth(handlers.MarkMessagesAsReadHandler)))
+
+	http.HandleFunc("/messages/edit", corsMiddleware(Auth.RequireAuth(handlers.EditMessageHandler)))
+	http.HandleFunc("/messages/delete", corsMiddleware(Auth.RequireAuth(handlers.DeleteMessageHandler)))
+	http.HandleFunc("/messages/edits", corsMiddleware(Auth.RequireAuth(handlers.MessageEditsHandler)))
+
+	http.HandleFunc("/presence", corsMiddleware(Auth.RequireAuth(handlers.PresenceHandler)))
+	http.HandleFunc("/settings/privacy", corsMiddleware(Auth.RequireAuth(handlers.PrivacySettingsHandler)))
 
 	http.HandleFunc("/creategroup", corsMiddleware(Auth.RequireAuth(handlers.CreateGroupHandler)))
 	http.HandleFunc("/groups", corsMiddleware(Auth.RequireAuth(handlers.GetGroupsHandler)))
@@ -82,6 +137,7 @@ func main() {
 	// Group Notifications
 	http.HandleFunc("/group-notifications", corsMiddleware(Auth.RequireAuth(handlers.GetGroupNotificationsHandler)))
 	http.HandleFunc("/mark-group-read", corsMiddleware(Auth.RequireAuth(handlers.MarkGroupAsReadHandler)))
+	http.HandleFunc("/group-messages/seen", corsMiddleware(Auth.RequireAuth(handlers.GroupMessageSeenByHandler)))
 	http.HandleFunc("/event-notifications", corsMiddleware(Auth.RequireAuth(handlers.GetEventNotificationsHandler)))
 	http.HandleFunc("/mark-event-read", corsMiddleware(Auth.RequireAuth(handlers.MarkEventAsReadHandler)))
 
@@ -109,9 +165,23 @@ func main() {
 	http.HandleFunc("/accept-group-invite", corsMiddleware(Auth.RequireAuth(handlers.AcceptGroupInviteHandler)))
 	http.HandleFunc("/reject-group-invite", corsMiddleware(Auth.RequireAuth(handlers.RejectGroupInviteHandler)))
 
-	http.HandleFunc("/chat/history", corsMiddleware(handlers.ChatHistoryHandler))
+	http.HandleFunc("/conversations", corsMiddleware(Auth.RequireAuth(handlers.ConversationsHandler)))
+	http.HandleFunc("/conversations/get", corsMiddleware(Auth.RequireAuth(handlers.GetConversationHandler)))
+	http.HandleFunc("/conversations/rename", corsMiddleware(Auth.RequireAuth(handlers.RenameConversationHandler)))
+	http.HandleFunc("/conversations/participants", corsMiddleware(Auth.RequireAuth(handlers.AddConversationParticipantsHandler)))
+	http.HandleFunc("/conversations/leave", corsMiddleware(Auth.RequireAuth(handlers.LeaveConversationHandler)))
+	http.HandleFunc("/conversations/messages", corsMiddleware(Auth.RequireAuth(handlers.ConversationMessagesHandler)))
+
+	http.HandleFunc("/chat/attachments", corsMiddleware(Auth.RequireAuth(handlers.UploadChatAttachmentHandler)))
+	http.HandleFunc("/chat/attachments/", corsMiddleware(Auth.RequireAuth(handlers.ServeChatAttachmentHandler)))
+	http.HandleFunc("/chat/mute", corsMiddleware(Auth.RequireAuth(handlers.MuteChatHandler)))
+	http.HandleFunc("/chat/unmute", corsMiddleware(Auth.RequireAuth(handlers.UnmuteChatHandler)))
+	http.HandleFunc("/chat/archive", corsMiddleware(Auth.RequireAuth(handlers.ArchiveChatHandler)))
+	http.HandleFunc("/chat/retention", corsMiddleware(Auth.RequireAuth(handlers.RetentionHandler)))
+	http.HandleFunc("/chat/preferences", corsMiddleware(Auth.RequireAuth(handlers.ChatPreferencesHandler)))
+	http.HandleFunc("/chat/history", corsMiddleware(Auth.RequireAuth(handlers.ChatHistoryHandler)))
 	http.HandleFunc("/chat/recent-users", corsMiddleware(handlers.ChatRecentUsersHandler))
-	http.HandleFunc("/chat/can-access", corsMiddleware(handlers.CanAccessChatHandler))
+	http.HandleFunc("/chat/can-access", corsMiddleware(Auth.RequireAuth(handlers.CanAccessChatHandler)))
 
 	// Notification endpoints
 	http.HandleFunc("/notifications", corsMiddleware(Auth.RequireAuth(handlers.GetNotificationsHandler)))
@@ -148,3 +218,39 @@ func corsMiddleware(handler http.HandlerFunc) http.HandlerFunc {
 		handler.ServeHTTP(w, r)
 	}
 }
+
+// newMailer sends mail through SMTP_ADDR when it is set, and otherwise writes
+// it to MAIL_LOG_FILE (or the log) for local development
+func newMailer() sessions.Mailer {
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		return &sessions.SMTPMailer{
+			Addr:     addr,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     envString("MAIL_FROM", "no-reply@socialhub.local"),
+		}
+	}
+	return &sessions.LogMailer{Path: os.Getenv("MAIL_LOG_FILE")}
+}
+
+// envString reads key from the environment, falling back to def when unset
+func envString(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// envDuration reads a duration such as "30s" from the environment, returning 0 when unset or invalid
+func envDuration(key string) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, value, err)
+		return 0
+	}
+	return d
+}
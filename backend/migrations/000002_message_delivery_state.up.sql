@@ -0,0 +1,8 @@
+ALTER TABLE messages ADD COLUMN delivered_at DATETIME DEFAULT NULL;
+ALTER TABLE messages ADD COLUMN read_at DATETIME DEFAULT NULL;
+
+-- Everything stored before delivery tracking was already replayed to clients
+UPDATE messages SET delivered_at = timestamp WHERE delivered_at IS NULL;
+UPDATE messages SET read_at = timestamp WHERE is_read = 1 AND read_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_messages_recipient_delivered ON messages(recipient, delivered_at);
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN read_receipts INTEGER NOT NULL DEFAULT 1;
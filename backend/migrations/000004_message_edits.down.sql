@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_message_edits_message_id;
+DROP TABLE IF EXISTS message_edits;
+ALTER TABLE messages DROP COLUMN deleted_at;
+ALTER TABLE messages DROP COLUMN edited_at;
@@ -0,0 +1,13 @@
+ALTER TABLE messages ADD COLUMN edited_at DATETIME DEFAULT NULL;
+ALTER TABLE messages ADD COLUMN deleted_at DATETIME DEFAULT NULL;
+
+-- Previous versions of edited direct messages, newest last
+CREATE TABLE IF NOT EXISTS message_edits (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id INTEGER NOT NULL,
+    previous_message TEXT NOT NULL,
+    edited_at DATETIME NOT NULL,
+    FOREIGN KEY (message_id) REFERENCES messages (message_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_edits_message_id ON message_edits(message_id);
@@ -0,0 +1,2 @@
+-- Chat history pages walk a conversation by message_id in each direction
+CREATE INDEX IF NOT EXISTS idx_messages_conversation ON messages(sender, recipient, message_id);
@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN show_last_seen;
+ALTER TABLE online_status DROP COLUMN state;
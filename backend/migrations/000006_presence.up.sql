@@ -0,0 +1,5 @@
+ALTER TABLE online_status ADD COLUMN state TEXT NOT NULL DEFAULT 'offline';
+ALTER TABLE users ADD COLUMN show_last_seen INTEGER NOT NULL DEFAULT 1;
+
+-- Nobody is connected while migrations run
+UPDATE online_status SET is_online = 0, state = 'offline';
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_messages_conversation_id;
+DELETE FROM messages WHERE recipient = '';
+ALTER TABLE messages DROP COLUMN conversation_id;
+DROP INDEX IF EXISTS idx_conversation_participants_nickname;
+DROP TABLE IF EXISTS conversation_participants;
+DROP TABLE IF EXISTS conversations;
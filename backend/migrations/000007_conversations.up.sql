@@ -0,0 +1,45 @@
+CREATE TABLE IF NOT EXISTS conversations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind TEXT NOT NULL CHECK (kind IN ('direct', 'group')),
+    title TEXT,
+    direct_a TEXT, -- for direct conversations, the two nicknames in sorted order
+    direct_b TEXT,
+    created_by TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (direct_a, direct_b)
+);
+
+CREATE TABLE IF NOT EXISTS conversation_participants (
+    conversation_id INTEGER NOT NULL,
+    nickname TEXT NOT NULL,
+    joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    left_at DATETIME DEFAULT NULL,
+    PRIMARY KEY (conversation_id, nickname),
+    FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY (nickname) REFERENCES users(nickname)
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversation_participants_nickname ON conversation_participants(nickname);
+
+-- Messages in multi-party conversations have an empty recipient
+ALTER TABLE messages ADD COLUMN conversation_id INTEGER DEFAULT NULL;
+
+-- Every existing pair of correspondents becomes a direct conversation
+INSERT OR IGNORE INTO conversations (kind, direct_a, direct_b, created_at)
+SELECT 'direct', MIN(sender, recipient), MAX(sender, recipient), MIN(timestamp)
+FROM messages
+GROUP BY MIN(sender, recipient), MAX(sender, recipient);
+
+INSERT OR IGNORE INTO conversation_participants (conversation_id, nickname, joined_at)
+SELECT id, direct_a, created_at FROM conversations WHERE kind = 'direct'
+UNION
+SELECT id, direct_b, created_at FROM conversations WHERE kind = 'direct';
+
+UPDATE messages SET conversation_id = (
+    SELECT c.id FROM conversations c
+    WHERE c.direct_a = MIN(messages.sender, messages.recipient)
+      AND c.direct_b = MAX(messages.sender, messages.recipient)
+)
+WHERE conversation_id IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_messages_conversation_id ON messages(conversation_id, message_id);
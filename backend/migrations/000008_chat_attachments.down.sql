@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_chat_attachments_group_message;
+DROP INDEX IF EXISTS idx_chat_attachments_message;
+DROP TABLE IF EXISTS chat_attachments;
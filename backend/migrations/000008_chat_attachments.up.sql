@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS chat_attachments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uploader TEXT NOT NULL,
+    file_name TEXT NOT NULL, -- name on disk in the attachments directory
+    original_name TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    message_id INTEGER DEFAULT NULL, -- set once sent in a direct or conversation message
+    group_message_id INTEGER DEFAULT NULL, -- or in a group chat message
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (uploader) REFERENCES users(nickname)
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_attachments_message ON chat_attachments(message_id);
+CREATE INDEX IF NOT EXISTS idx_chat_attachments_group_message ON chat_attachments(group_message_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS group_message_reactions;
+DROP TABLE IF EXISTS message_reactions;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS message_reactions (
+    message_id INTEGER NOT NULL,
+    nickname TEXT NOT NULL,
+    emoji TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (message_id, nickname, emoji),
+    FOREIGN KEY (message_id) REFERENCES messages(message_id) ON DELETE CASCADE,
+    FOREIGN KEY (nickname) REFERENCES users(nickname)
+);
+
+CREATE TABLE IF NOT EXISTS group_message_reactions (
+    group_message_id INTEGER NOT NULL,
+    nickname TEXT NOT NULL,
+    emoji TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (group_message_id, nickname, emoji),
+    FOREIGN KEY (nickname) REFERENCES users(nickname)
+);
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS idx_group_messages_group ON group_messages(group_id, id);
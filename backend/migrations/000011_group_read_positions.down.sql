@@ -0,0 +1 @@
+ALTER TABLE group_message_notifications DROP COLUMN last_read_at;
@@ -0,0 +1,15 @@
+-- group_message_notifications is otherwise created by CreateGroupTables, which
+-- runs after the migrations, so create it here for a fresh database (matches
+-- the schema from CreateGroupTables function)
+CREATE TABLE IF NOT EXISTS group_message_notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    group_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    last_read_message_id INTEGER DEFAULT 0,
+    unread_count INTEGER DEFAULT 0,
+    FOREIGN KEY (group_id) REFERENCES groups(group_id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(uid) ON DELETE CASCADE,
+    UNIQUE(group_id, user_id)
+);
+
+ALTER TABLE group_message_notifications ADD COLUMN last_read_at TEXT;
@@ -0,0 +1,13 @@
+-- Per-user mute and archive settings. kind is 'conversation' (direct and
+-- multi-party conversations) or 'group', target_id the conversation or group id.
+-- muted_until is an RFC3339 UTC time; muting forever stores the far future.
+CREATE TABLE IF NOT EXISTS chat_preferences (
+    user_id INTEGER NOT NULL,
+    kind TEXT NOT NULL CHECK (kind IN ('conversation', 'group')),
+    target_id INTEGER NOT NULL,
+    muted_until TEXT,
+    count_unread INTEGER NOT NULL DEFAULT 1,
+    archived_at TEXT,
+    PRIMARY KEY (user_id, kind, target_id),
+    FOREIGN KEY (user_id) REFERENCES users(uid) ON DELETE CASCADE
+);
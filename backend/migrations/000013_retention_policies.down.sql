@@ -0,0 +1,6 @@
+ALTER TABLE groups DROP COLUMN retention_updated_at;
+ALTER TABLE groups DROP COLUMN retention_updated_by;
+ALTER TABLE groups DROP COLUMN retention_seconds;
+ALTER TABLE conversations DROP COLUMN retention_updated_at;
+ALTER TABLE conversations DROP COLUMN retention_updated_by;
+ALTER TABLE conversations DROP COLUMN retention_seconds;
@@ -0,0 +1,8 @@
+-- Disappearing messages: messages older than retention_seconds are removed
+-- by the sweeper. NULL keeps messages forever.
+ALTER TABLE conversations ADD COLUMN retention_seconds INTEGER;
+ALTER TABLE conversations ADD COLUMN retention_updated_by TEXT;
+ALTER TABLE conversations ADD COLUMN retention_updated_at TEXT;
+ALTER TABLE groups ADD COLUMN retention_seconds INTEGER;
+ALTER TABLE groups ADD COLUMN retention_updated_by TEXT;
+ALTER TABLE groups ADD COLUMN retention_updated_at TEXT;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_sessions_session;
+DROP INDEX IF EXISTS idx_sessions_user;
+ALTER TABLE sessions DROP COLUMN last_seen_at;
+ALTER TABLE sessions DROP COLUMN ip;
+ALTER TABLE sessions DROP COLUMN user_agent;
@@ -0,0 +1,22 @@
+DELETE FROM notifications WHERE type = 'security_alert';
+
+CREATE TABLE notifications_old (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    type TEXT NOT NULL CHECK (type IN ('follow_request', 'group_invite', 'group_join_request', 'event_created', 'post_interaction', 'new_message', 'group_message')),
+    message TEXT NOT NULL,
+    is_read INTEGER DEFAULT 0,
+    related_id INTEGER, -- ID of related entity (follow request, group, event, etc.)
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(uid) ON DELETE CASCADE
+);
+INSERT INTO notifications_old (id, user_id, type, message, is_read, related_id, created_at)
+    SELECT id, user_id, type, message, is_read, related_id, created_at FROM notifications;
+DROP TABLE notifications;
+ALTER TABLE notifications_old RENAME TO notifications;
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id);
+CREATE INDEX IF NOT EXISTS idx_notifications_type ON notifications(type);
+CREATE INDEX IF NOT EXISTS idx_notifications_is_read ON notifications(is_read);
+
+DROP TABLE IF EXISTS login_attempts;
@@ -0,0 +1,27 @@
+-- Failed login attempts, keyed by "ip:<address>" or "email:<address>"
+CREATE TABLE IF NOT EXISTS login_attempts (
+    attempt_key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TEXT NOT NULL,
+    locked_until TEXT
+);
+
+-- SQLite cannot alter a CHECK constraint, so rebuild notifications to allow security_alert
+CREATE TABLE notifications_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    type TEXT NOT NULL CHECK (type IN ('follow_request', 'group_invite', 'group_join_request', 'event_created', 'post_interaction', 'new_message', 'group_message', 'security_alert')),
+    message TEXT NOT NULL,
+    is_read INTEGER DEFAULT 0,
+    related_id INTEGER, -- ID of related entity (follow request, group, event, etc.)
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(uid) ON DELETE CASCADE
+);
+INSERT INTO notifications_new (id, user_id, type, message, is_read, related_id, created_at)
+    SELECT id, user_id, type, message, is_read, related_id, created_at FROM notifications;
+DROP TABLE notifications;
+ALTER TABLE notifications_new RENAME TO notifications;
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id);
+CREATE INDEX IF NOT EXISTS idx_notifications_type ON notifications(type);
+CREATE INDEX IF NOT EXISTS idx_notifications_is_read ON notifications(is_read);
@@ -0,0 +1,30 @@
+-- A row without enabled_at is an enrollment waiting for its first code.
+-- last_used_step is the newest TOTP time step accepted, so codes can't be replayed.
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id INTEGER PRIMARY KEY,
+    secret TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    enabled_at TEXT,
+    last_used_step INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (user_id) REFERENCES users(uid) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    code_hash TEXT NOT NULL UNIQUE,
+    used_at TEXT,
+    FOREIGN KEY (user_id) REFERENCES users(uid) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_totp_recovery_codes_user ON totp_recovery_codes(user_id);
+
+-- Logins that passed the password check and wait for the second factor
+CREATE TABLE IF NOT EXISTS login_challenges (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at TEXT NOT NULL,
+    expires_at TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (user_id) REFERENCES users(uid) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_live_connections_nickname;
+DROP TABLE IF EXISTS live_connections;
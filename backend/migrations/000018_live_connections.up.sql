@@ -0,0 +1,10 @@
+-- WebSocket connections each instance holds, per user. Instances refresh
+-- seen_at while they run; rows of an instance that stopped refreshing are stale.
+CREATE TABLE IF NOT EXISTS live_connections (
+    instance_id TEXT NOT NULL,
+    nickname TEXT NOT NULL,
+    connections INTEGER NOT NULL,
+    seen_at TEXT NOT NULL,
+    PRIMARY KEY (instance_id, nickname)
+);
+CREATE INDEX IF NOT EXISTS idx_live_connections_nickname ON live_connections(nickname);
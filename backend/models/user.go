@@ -9,3 +9,14 @@ type UpdateProfileRequest struct {
 	IsPublic  string `json:"isPublic"`
 	About_Me  string `json:"about_me"`
 }
+
+type PrivacySettings struct {
+	ReadReceipts bool `json:"read_receipts"`
+	ShowLastSeen bool `json:"show_last_seen"`
+}
+
+// UpdatePrivacySettingsRequest only changes the fields that are present
+type UpdatePrivacySettingsRequest struct {
+	ReadReceipts *bool `json:"read_receipts"`
+	ShowLastSeen *bool `json:"show_last_seen"`
+}
@@ -0,0 +1,50 @@
+// Package pubsub carries real-time frames between backend instances so a
+// user connected to one replica can reach users connected to another.
+package pubsub
+
+import "sync"
+
+// Handler receives every payload published on a channel it subscribed to.
+// Handlers for one channel are called in publish order, one at a time.
+type Handler func(payload []byte)
+
+// Broker publishes payloads to every subscriber of a channel, including
+// subscribers in the publishing process
+type Broker interface {
+	Publish(channel string, payload []byte) error
+	Subscribe(channel string, handler Handler) error
+	Close() error
+}
+
+// Local is an in-process Broker for running a single instance
+type Local struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+func NewLocal() *Local {
+	return &Local{handlers: make(map[string][]Handler)}
+}
+
+// Publish calls the channel's handlers synchronously
+func (l *Local) Publish(channel string, payload []byte) error {
+	l.mu.RLock()
+	handlers := l.handlers[channel]
+	l.mu.RUnlock()
+
+	for _, h := range handlers {
+		h(payload)
+	}
+	return nil
+}
+
+func (l *Local) Subscribe(channel string, handler Handler) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handlers[channel] = append(l.handlers[channel], handler)
+	return nil
+}
+
+func (l *Local) Close() error {
+	return nil
+}
@@ -0,0 +1,319 @@
+package pubsub
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisDialTimeout  = 5 * time.Second
+	redisWriteTimeout = 5 * time.Second
+	redisMaxBackoff   = 5 * time.Second
+)
+
+// Redis is a Broker backed by Redis PUBLISH/SUBSCRIBE. It keeps one
+// connection for publishing and one for the subscription, and redials either
+// when it breaks. Payloads published while Redis is unreachable are lost.
+type Redis struct {
+	addr     string
+	username string
+	password string
+
+	pubMu sync.Mutex
+	pub   *redisConn
+
+	subMu    sync.Mutex
+	sub      *redisConn
+	handlers map[string][]Handler
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewRedis connects to the server in rawURL, e.g. redis://:secret@localhost:6379
+func NewRedis(rawURL string) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %v", err)
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported pubsub url scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	r := &Redis{
+		addr:     addr,
+		handlers: make(map[string][]Handler),
+		closed:   make(chan struct{}),
+	}
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+
+	// Fail fast on a bad address or password instead of at the first publish
+	conn, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+	r.pub = conn
+
+	go r.subscribeLoop()
+	return r, nil
+}
+
+// Publish sends payload to every instance subscribed to channel, retrying
+// once on a fresh connection if the current one has gone away
+func (r *Redis) Publish(channel string, payload []byte) error {
+	r.pubMu.Lock()
+	defer r.pubMu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if r.pub == nil {
+			if r.pub, err = r.dial(); err != nil {
+				continue
+			}
+		}
+		if _, err = r.pub.do("PUBLISH", channel, string(payload)); err == nil {
+			return nil
+		}
+		var serverErr redisError
+		if errors.As(err, &serverErr) {
+			return err
+		}
+		r.pub.Close()
+		r.pub = nil
+	}
+	return err
+}
+
+// Subscribe registers handler for channel. Handlers run on the subscription's
+// reader goroutine, so they should not block.
+func (r *Redis) Subscribe(channel string, handler Handler) error {
+	r.subMu.Lock()
+	defer r.subMu.Unlock()
+
+	_, known := r.handlers[channel]
+	r.handlers[channel] = append(r.handlers[channel], handler)
+	if known || r.sub == nil {
+		// The subscribe loop subscribes to every channel when it (re)connects
+		return nil
+	}
+	return r.sub.send("SUBSCRIBE", channel)
+}
+
+func (r *Redis) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.pubMu.Lock()
+		if r.pub != nil {
+			r.pub.Close()
+		}
+		r.pubMu.Unlock()
+		r.subMu.Lock()
+		if r.sub != nil {
+			r.sub.Close()
+		}
+		r.subMu.Unlock()
+	})
+	return nil
+}
+
+func (r *Redis) isClosed() bool {
+	select {
+	case <-r.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *Redis) subscribeLoop() {
+	backoff := 100 * time.Millisecond
+	for !r.isClosed() {
+		err := r.runSubscription()
+		if r.isClosed() {
+			return
+		}
+		log.Printf("Redis subscription to %s lost: %v, reconnecting in %s", r.addr, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-r.closed:
+			return
+		}
+		if backoff *= 2; backoff > redisMaxBackoff {
+			backoff = redisMaxBackoff
+		}
+	}
+}
+
+// runSubscription subscribes to every known channel and dispatches messages
+// until the connection fails
+func (r *Redis) runSubscription() error {
+	conn, err := r.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	r.subMu.Lock()
+	channels := make([]string, 0, len(r.handlers))
+	for channel := range r.handlers {
+		channels = append(channels, channel)
+	}
+	if len(channels) > 0 {
+		if err := conn.send(append([]string{"SUBSCRIBE"}, channels...)...); err != nil {
+			r.subMu.Unlock()
+			return err
+		}
+	}
+	r.sub = conn
+	r.subMu.Unlock()
+
+	defer func() {
+		r.subMu.Lock()
+		if r.sub == conn {
+			r.sub = nil
+		}
+		r.subMu.Unlock()
+	}()
+
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 {
+			continue
+		}
+		kind, _ := parts[0].(string)
+		channel, _ := parts[1].(string)
+		payload, _ := parts[2].(string)
+		if kind != "message" {
+			continue
+		}
+
+		r.subMu.Lock()
+		handlers := r.handlers[channel]
+		r.subMu.Unlock()
+		for _, h := range handlers {
+			h([]byte(payload))
+		}
+	}
+}
+
+func (r *Redis) dial() (*redisConn, error) {
+	nc, err := net.DialTimeout("tcp", r.addr, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if r.password != "" {
+		args := []string{"AUTH", r.password}
+		if r.username != "" {
+			args = []string{"AUTH", r.username, r.password}
+		}
+		if _, err := conn.do(args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis auth failed: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisConn speaks just enough RESP for PUBLISH, SUBSCRIBE and AUTH
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *redisConn) send(args ...string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	c.SetWriteDeadline(time.Now().Add(redisWriteTimeout))
+	_, err := c.Write(buf)
+	return err
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	c.SetReadDeadline(time.Now().Add(redisWriteTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	return c.read()
+}
+
+// read parses one reply. Bulk strings come back as string, integers as
+// int64, arrays as []interface{} and error replies as a redisError.
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed redis reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unknown redis reply type %q", kind)
+	}
+}
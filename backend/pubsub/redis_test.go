@@ -0,0 +1,279 @@
+package pubsub
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// fakeRedis is a TCP listener that hands each accepted connection to the
+// test, which plays the server's side of the conversation by hand
+type fakeRedis struct {
+	ln    net.Listener
+	conns chan *fakeConn
+}
+
+type fakeConn struct {
+	*redisConn
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &fakeRedis{ln: ln, conns: make(chan *fakeConn, 8)}
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns <- &fakeConn{&redisConn{Conn: nc, r: bufio.NewReader(nc)}}
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *fakeRedis) url() string {
+	return "redis://" + s.ln.Addr().String()
+}
+
+// accept waits for the client's next connection
+func (s *fakeRedis) accept(t *testing.T) *fakeConn {
+	t.Helper()
+	select {
+	case c := <-s.conns:
+		t.Cleanup(func() { c.Close() })
+		return c
+	case <-time.After(2 * time.Second):
+		t.Fatal("client did not connect")
+		return nil
+	}
+}
+
+// expect reads one command from the client and checks its arguments
+func (c *fakeConn) expect(t *testing.T, args ...string) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply, err := c.read()
+	if err != nil {
+		t.Fatalf("reading command: %v", err)
+	}
+	items, _ := reply.([]interface{})
+	got := make([]string, len(items))
+	for i, item := range items {
+		got[i], _ = item.(string)
+	}
+	if !reflect.DeepEqual(got, args) {
+		t.Fatalf("got command %q, want %q", got, args)
+	}
+}
+
+func (c *fakeConn) write(t *testing.T, raw string) {
+	t.Helper()
+	if _, err := c.Write([]byte(raw)); err != nil {
+		t.Fatalf("writing reply: %v", err)
+	}
+}
+
+// writeSlowly sends raw a few bytes at a time so the client sees partial reads
+func (c *fakeConn) writeSlowly(t *testing.T, raw string) {
+	t.Helper()
+	for len(raw) > 0 {
+		n := min(3, len(raw))
+		c.write(t, raw[:n])
+		raw = raw[n:]
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func messageFrame(channel, payload string) string {
+	return "*3\r\n$7\r\nmessage\r\n$" + strconv.Itoa(len(channel)) + "\r\n" + channel + "\r\n$" +
+		strconv.Itoa(len(payload)) + "\r\n" + payload + "\r\n"
+}
+
+func TestRedisConnRead(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want interface{}
+	}{
+		{"simple string", "+OK\r\n", "OK"},
+		{"integer", ":42\r\n", int64(42)},
+		{"bulk string", "$5\r\nhello\r\n", "hello"},
+		{"bulk string with CRLF", "$4\r\na\r\nb\r\n", "a\r\nb"},
+		{"null bulk string", "$-1\r\n", nil},
+		{"array", "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", []interface{}{"message", "ch", "hi"}},
+		{"nested array", "*2\r\n:1\r\n*1\r\n+x\r\n", []interface{}{int64(1), []interface{}{"x"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// One byte per read, so every reply arrives split up
+			c := &redisConn{r: bufio.NewReader(iotest.OneByteReader(strings.NewReader(tt.raw)))}
+			got, err := c.read()
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedisConnReadErrors(t *testing.T) {
+	c := &redisConn{r: bufio.NewReader(strings.NewReader("-ERR unknown command\r\n"))}
+	_, err := c.read()
+	var serverErr redisError
+	if !errors.As(err, &serverErr) || string(serverErr) != "ERR unknown command" {
+		t.Fatalf("got %v, want redis error reply", err)
+	}
+
+	for _, raw := range []string{"OK\n", "?what\r\n", ":abc\r\n", "$5\r\nhel", "*2\r\n:1\r\n"} {
+		c := &redisConn{r: bufio.NewReader(strings.NewReader(raw))}
+		if _, err := c.read(); err == nil {
+			t.Errorf("read %q: expected an error", raw)
+		}
+	}
+}
+
+func TestRedisAuthFailure(t *testing.T) {
+	s := newFakeRedis(t)
+	go func() {
+		c := <-s.conns
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		c.read()
+		c.Write([]byte("-WRONGPASS invalid username-password pair\r\n"))
+	}()
+
+	_, err := NewRedis("redis://:secret@" + s.ln.Addr().String())
+	if err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Fatalf("got %v, want auth failure", err)
+	}
+}
+
+func TestRedisPublish(t *testing.T) {
+	s := newFakeRedis(t)
+	r, err := NewRedis(s.url())
+	if err != nil {
+		t.Fatalf("NewRedis: %v", err)
+	}
+	defer r.Close()
+	pub := s.accept(t)
+	s.accept(t) // subscription
+
+	publish := func() chan error {
+		done := make(chan error, 1)
+		go func() { done <- r.Publish("events", []byte("payload")) }()
+		return done
+	}
+
+	done := publish()
+	pub.expect(t, "PUBLISH", "events", "payload")
+	pub.write(t, ":2\r\n")
+	if err := <-done; err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	// An error reply is returned as is and keeps the connection
+	done = publish()
+	pub.expect(t, "PUBLISH", "events", "payload")
+	pub.write(t, "-READONLY You can't write against a read only replica\r\n")
+	var serverErr redisError
+	if err := <-done; !errors.As(err, &serverErr) {
+		t.Fatalf("got %v, want redis error reply", err)
+	}
+	done = publish()
+	pub.expect(t, "PUBLISH", "events", "payload")
+	pub.write(t, ":1\r\n")
+	if err := <-done; err != nil {
+		t.Fatalf("Publish after error reply: %v", err)
+	}
+}
+
+func TestRedisPublishRedials(t *testing.T) {
+	s := newFakeRedis(t)
+	r, err := NewRedis(s.url())
+	if err != nil {
+		t.Fatalf("NewRedis: %v", err)
+	}
+	defer r.Close()
+	pub := s.accept(t)
+	s.accept(t) // subscription
+
+	// The server drops the connection; Publish retries once on a new one
+	pub.Close()
+	done := make(chan error, 1)
+	go func() { done <- r.Publish("events", []byte("payload")) }()
+	retry := s.accept(t)
+	retry.expect(t, "PUBLISH", "events", "payload")
+	retry.write(t, ":1\r\n")
+	if err := <-done; err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	// With the server gone both attempts fail
+	retry.Close()
+	s.ln.Close()
+	if err := r.Publish("events", []byte("payload")); err == nil {
+		t.Fatal("Publish succeeded without a server")
+	}
+}
+
+func TestRedisSubscribeResubscribesAfterDrop(t *testing.T) {
+	s := newFakeRedis(t)
+	r, err := NewRedis(s.url())
+	if err != nil {
+		t.Fatalf("NewRedis: %v", err)
+	}
+	defer r.Close()
+	s.accept(t) // publishing
+	sub := s.accept(t)
+
+	got := make(chan string, 4)
+	if err := r.Subscribe("events", func(payload []byte) { got <- string(payload) }); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	sub.expect(t, "SUBSCRIBE", "events")
+	sub.write(t, "*3\r\n$9\r\nsubscribe\r\n$6\r\nevents\r\n:1\r\n")
+	sub.write(t, messageFrame("other", "ignored"))
+	sub.writeSlowly(t, messageFrame("events", "first"))
+	expectPayload(t, got, "first")
+
+	// Drop the connection halfway through a message
+	partial := messageFrame("events", "lost")
+	sub.write(t, partial[:len(partial)-4])
+	sub.Close()
+
+	again := s.accept(t)
+	again.expect(t, "SUBSCRIBE", "events")
+	again.write(t, messageFrame("events", "second"))
+	expectPayload(t, got, "second")
+	select {
+	case payload := <-got:
+		t.Fatalf("unexpected payload %q", payload)
+	default:
+	}
+}
+
+func expectPayload(t *testing.T, got <-chan string, want string) {
+	t.Helper()
+	select {
+	case payload := <-got:
+		if payload != want {
+			t.Fatalf("got payload %q, want %q", payload, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no payload, want %q", want)
+	}
+}
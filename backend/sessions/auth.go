@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -14,6 +16,74 @@ import (
 type AuthHandler struct {
 	SessionStore *SessionStore
 	DB           *sql.DB
+
+	// Mailer delivers password reset links to ResetURL?token=..., which
+	// expire after ResetTokenTTL (an hour when zero)
+	Mailer        Mailer
+	ResetURL      string
+	ResetTokenTTL time.Duration
+
+	// OnLockout is called when repeated failed logins lock an account
+	OnLockout func(userID int, until time.Time)
+}
+
+// writeLoginError answers a failed login with a JSON error
+func writeLoginError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// writeTooManyAttempts answers a throttled login, telling the client when to retry
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	writeLoginError(w, http.StatusTooManyRequests, tooManyAttemptsMessage)
+}
+
+// startSession signs userID in on the requesting device
+func (h *AuthHandler) startSession(w http.ResponseWriter, r *http.Request, userID int, nickname string) {
+	session, err := h.SessionStore.CreateSession(userID, r.UserAgent(), ClientIP(r))
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, session)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":    "Login successful",
+		"session_id": session.ID,
+		"nickname":   nickname,
+	})
+}
+
+// reserveLogin counts an attempt against the client's IP and the email it
+// tried before the credentials are checked. It answers the request and
+// returns false when the caller has to wait first.
+func (h *AuthHandler) reserveLogin(w http.ResponseWriter, ip, email string) (map[string]time.Time, bool) {
+	wait, locked, err := reserveLoginAttempt(h.DB, ipLoginKey(ip), emailLoginKey(email))
+	if err != nil {
+		log.Printf("Login throttle lookup failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return nil, false
+	}
+	return locked, true
+}
+
+// loginFailed reports an account lockout caused by a failed attempt to its owner
+func (h *AuthHandler) loginFailed(email string, userID int, locked map[string]time.Time) {
+	until, ok := locked[emailAttemptKey(email)]
+	if !ok || userID <= 0 {
+		return
+	}
+	log.Printf("Locked logins for user %d until %s", userID, until.Format(time.RFC3339))
+	if h.OnLockout != nil {
+		h.OnLockout(userID, until)
+	}
 }
 
 func (h *AuthHandler) AuthStatus(w http.ResponseWriter, r *http.Request) {
@@ -26,12 +96,15 @@ func (h *AuthHandler) AuthStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get session from store
-	session, err := h.SessionStore.GetSession(cookie.Value)
-	if err != nil || session.UserID == 0 {
-		log.Println("AuthStatus: Invalid session")
+	session, err := h.SessionStore.Validate(cookie.Value)
+	if err != nil {
+		log.Println("AuthStatus: Invalid session:", err)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	if session.Renewed {
+		setSessionCookie(w, session)
+	}
 
 	// Get user from database
 	var nickname string
@@ -68,6 +141,12 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := ClientIP(r)
+	locked, allowed := h.reserveLogin(w, ip, req.Email)
+	if !allowed {
+		return
+	}
+
 	var user struct {
 		ID       int
 		Password string
@@ -75,49 +154,49 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	err = h.DB.QueryRow("SELECT uid, password, nickname FROM users WHERE email = ?", req.Email).Scan(&user.ID, &user.Password, &user.Nickname)
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+		writeLoginError(w, http.StatusUnauthorized, invalidLoginMessage)
+		return
+	}
 	if err != nil {
-		fmt.Printf("err: %v\n", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		log.Printf("Login: Database error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid password"})
+		h.loginFailed(req.Email, user.ID, locked)
+		writeLoginError(w, http.StatusUnauthorized, invalidLoginMessage)
 		return
 	}
+	releaseLoginAttempt(h.DB, locked, ipLoginKey(ip), emailLoginKey(req.Email))
 
-	session, err := h.SessionStore.CreateSession(user.ID)
+	// With 2FA the password only earns a challenge for LoginTwoFactor
+	enabled, err := h.twoFactorEnabled(user.ID)
 	if err != nil {
+		log.Printf("Login: Database error: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if enabled {
+		challenge, err := h.createLoginChallenge(user.ID)
+		if err != nil {
+			log.Printf("Failed to create login challenge: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":             "Two-factor code required",
+			"two_factor_required": true,
+			"challenge":           challenge,
+		})
+		return
+	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_id",
-		Value:    session.ID,
-		Path:     "/",
-		Expires:  session.ExpiresAt,
-		HttpOnly: true,
-		Secure:   false, // Set to true in production with HTTPS
-		SameSite: http.SameSiteLaxMode,
-	})
-
-	fmt.Println("Login attempt:", req.Email)
-	fmt.Println("User ID:", user.ID, "Nickname:", user.Nickname)
-
-	// w.WriteHeader(http.StatusOK)
-	// w.Write([]byte("Login successful"))
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"message":    "Login successful",
-		"session_id": session.ID,
-		"nickname":   user.Nickname,
-	})
-
+	clearLoginFailures(h.DB, emailAttemptKey(req.Email))
+	h.startSession(w, r, user.ID, user.Nickname)
 }
 
 func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
@@ -159,12 +238,19 @@ func (h *AuthHandler) RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 		}
 		// Session cookie found
 
-		session, err := h.SessionStore.GetSession(cookie.Value)
-		if err != nil || session.UserID == 0 {
+		session, err := h.SessionStore.Validate(cookie.Value)
+		if err == ErrSessionExpired {
+			http.Error(w, "Unauthorized - Session expired", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
 			fmt.Println("Unauthorized - Invalid session")
 			http.Error(w, "Unauthorized - Invalid session", http.StatusUnauthorized)
 			return
 		}
+		if session.Renewed {
+			setSessionCookie(w, session)
+		}
 
 		// Add user ID to context
 		ctx := context.WithValue(r.Context(), "userID", session.UserID)
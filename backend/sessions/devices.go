@@ -0,0 +1,170 @@
+package sessions
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// lastSeenResolution limits how often a session's last_seen_at is rewritten
+const lastSeenResolution = time.Minute
+
+// DeviceSession describes one signed-in device. ID is the row id, never the
+// session token itself.
+type DeviceSession struct {
+	ID         int     `json:"id"`
+	UserAgent  string  `json:"user_agent"`
+	IP         string  `json:"ip"`
+	CreatedAt  string  `json:"created_at"`
+	LastSeenAt *string `json:"last_seen_at,omitempty"`
+	ExpiresAt  string  `json:"expires_at"`
+	Current    bool    `json:"current"`
+}
+
+// ClientIP returns the address the request came from, without the port
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Touch records that sessionID was just used. Writes are skipped while the
+// stored time is less than lastSeenResolution old.
+func (ss *SessionStore) Touch(sessionID string) {
+	now := time.Now().UTC()
+	_, err := ss.DB.Exec(`
+		UPDATE sessions SET last_seen_at = ?
+		WHERE session = ? AND (last_seen_at IS NULL OR last_seen_at < ?)
+	`, now.Format(time.RFC3339), sessionID, now.Add(-lastSeenResolution).Format(time.RFC3339))
+	if err != nil {
+		log.Printf("Failed to update session last seen: %v", err)
+	}
+}
+
+// ListSessions returns userID's sessions, most recently used first, marking currentID
+func (ss *SessionStore) ListSessions(userID int, currentID string) ([]DeviceSession, error) {
+	rows, err := ss.DB.Query(`
+		SELECT id, session, user_agent, ip, timestamp, last_seen_at, expires_at
+		FROM sessions WHERE user_id = ?
+		ORDER BY COALESCE(last_seen_at, timestamp) DESC, id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []DeviceSession{}
+	for rows.Next() {
+		var (
+			s         DeviceSession
+			token     string
+			createdAt time.Time
+			expiresAt time.Time
+		)
+		if err := rows.Scan(&s.ID, &token, &s.UserAgent, &s.IP, &createdAt, &s.LastSeenAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		s.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+		s.ExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+		s.Current = token == currentID
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// currentSession returns the caller's session token and user. RequireAuth
+// has already checked it, so a failure here means it was revoked meanwhile.
+func (h *AuthHandler) currentSession(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	cookie, err := r.Cookie("session_id")
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", 0, false
+	}
+	session, err := h.SessionStore.GetSession(cookie.Value)
+	if err != nil || session.UserID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", 0, false
+	}
+	return session.ID, session.UserID, true
+}
+
+// ListSessions - GET /sessions lists the caller's signed-in devices
+func (h *AuthHandler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	current, userID, ok := h.currentSession(w, r)
+	if !ok {
+		return
+	}
+	list, err := h.SessionStore.ListSessions(userID, current)
+	if err != nil {
+		log.Printf("Failed to list sessions of user %d: %v", userID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// RevokeSession - POST /sessions/revoke {"id": 3} signs one of the caller's devices out
+func (h *AuthHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, userID, ok := h.currentSession(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == 0 {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := h.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM sessions WHERE id = ? AND user_id = ?)",
+		req.ID, userID).Scan(&exists); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err := h.SessionStore.deleteWhere("id = ? AND user_id = ?", req.ID, userID); err != nil {
+		log.Printf("Failed to revoke session %d of user %d: %v", req.ID, userID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Session revoked"})
+}
+
+// RevokeOtherSessions - POST /sessions/revoke-others signs out every device
+// except the one making the request
+func (h *AuthHandler) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	current, userID, ok := h.currentSession(w, r)
+	if !ok {
+		return
+	}
+	if err := h.SessionStore.deleteWhere("user_id = ? AND session != ?", userID, current); err != nil {
+		log.Printf("Failed to revoke other sessions of user %d: %v", userID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Signed out of all other sessions"})
+}
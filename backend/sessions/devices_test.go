@@ -0,0 +1,128 @@
+package sessions
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// insertDevice stores a session of userID signed in from userAgent and
+// returns its row id
+func insertDevice(t *testing.T, db *sql.DB, userID int, session, userAgent string, lastSeen time.Time) int {
+	t.Helper()
+	now := time.Now()
+	result, err := db.Exec("INSERT INTO sessions (session, user_id, expires_at, timestamp, user_agent, last_seen_at) VALUES (?, ?, ?, ?, ?, ?)",
+		session, userID, now.Add(time.Hour), now.Add(-time.Hour), userAgent, lastSeen.UTC().Format(time.RFC3339))
+	if err != nil {
+		t.Fatalf("insert session: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	return int(id)
+}
+
+// deviceRequest calls handler as the holder of session
+func deviceRequest(handler http.HandlerFunc, method, session, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/sessions", strings.NewReader(body))
+	r.AddCookie(&http.Cookie{Name: "session_id", Value: session})
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func newDevicesTestHandler(t *testing.T) (*AuthHandler, *sql.DB, *[]string) {
+	t.Helper()
+	db := newTestDB(t)
+	revoked := &[]string{}
+	ss := &SessionStore{DB: db, OnRevoke: func(ids []string) { *revoked = append(*revoked, ids...) }}
+	return &AuthHandler{DB: db, SessionStore: ss}, db, revoked
+}
+
+func TestListSessions(t *testing.T) {
+	h, db, _ := newDevicesTestHandler(t)
+	now := time.Now()
+	insertDevice(t, db, 1, "laptop", "Firefox", now.Add(-time.Hour))
+	insertDevice(t, db, 1, "phone", "Safari", now)
+	insertDevice(t, db, 2, "someone else", "Chrome", now)
+
+	w := deviceRequest(h.ListSessions, http.MethodGet, "laptop", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var list []DeviceSession
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	// Only the caller's devices, most recently used first
+	if len(list) != 2 || list[0].UserAgent != "Safari" || list[1].UserAgent != "Firefox" {
+		t.Fatalf("got %+v, want the phone then the laptop", list)
+	}
+	if list[0].Current || !list[1].Current {
+		t.Errorf("got current=%v,%v, want only the laptop marked", list[0].Current, list[1].Current)
+	}
+	if strings.Contains(w.Body.String(), "laptop") {
+		t.Error("session tokens were listed")
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	h, db, revoked := newDevicesTestHandler(t)
+	now := time.Now()
+	insertDevice(t, db, 1, "laptop", "Firefox", now)
+	phone := insertDevice(t, db, 1, "phone", "Safari", now)
+	other := insertDevice(t, db, 2, "someone else", "Chrome", now)
+
+	// Another user's session looks like it doesn't exist
+	w := deviceRequest(h.RevokeSession, http.MethodPost, "laptop", `{"id": `+strconv.Itoa(other)+`}`)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("revoking another user's session: got status %d, want 404", w.Code)
+	}
+	if !sessionExists(t, db, "someone else") || len(*revoked) != 0 {
+		t.Fatal("another user's session was revoked")
+	}
+
+	w = deviceRequest(h.RevokeSession, http.MethodPost, "laptop", `{"id": `+strconv.Itoa(phone)+`}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if sessionExists(t, db, "phone") || !sessionExists(t, db, "laptop") {
+		t.Fatal("want only the phone signed out")
+	}
+	if len(*revoked) != 1 || (*revoked)[0] != "phone" {
+		t.Errorf("OnRevoke got %v, want the phone", *revoked)
+	}
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	h, db, revoked := newDevicesTestHandler(t)
+	now := time.Now()
+	insertDevice(t, db, 1, "laptop", "Firefox", now)
+	insertDevice(t, db, 1, "phone", "Safari", now)
+	insertDevice(t, db, 1, "tablet", "Safari", now)
+	insertDevice(t, db, 2, "someone else", "Chrome", now)
+
+	w := deviceRequest(h.RevokeOtherSessions, http.MethodPost, "laptop", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	if !sessionExists(t, db, "laptop") {
+		t.Error("the current session was revoked")
+	}
+	if !sessionExists(t, db, "someone else") {
+		t.Error("another user's session was revoked")
+	}
+	for _, id := range []string{"phone", "tablet"} {
+		if sessionExists(t, db, id) {
+			t.Errorf("session %s was not revoked", id)
+		}
+	}
+	if len(*revoked) != 2 {
+		t.Errorf("OnRevoke got %v, want the phone and the tablet", *revoked)
+	}
+}
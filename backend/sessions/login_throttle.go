@@ -0,0 +1,199 @@
+package sessions
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Login throttling. Every failed attempt is counted against the client's IP
+// and the email it tried; attempts are counted as failures up front and
+// taken back when the password was right. Past a few free failures each further attempt has
+// to wait twice as long as the one before, up to maxLoginBackoff, and
+// reaching the lockout threshold blocks the key for loginLockout. An IP gets
+// more slack than an account since many users can share one. Failures older
+// than loginFailureWindow are forgotten.
+const (
+	accountFreeFailures = 3
+	ipFreeFailures      = 10
+	baseLoginBackoff    = time.Second
+	maxLoginBackoff     = 5 * time.Minute
+	accountLockAfter    = 10
+	ipLockAfter         = 50
+	loginLockout        = 15 * time.Minute
+	loginFailureWindow  = 15 * time.Minute
+)
+
+// invalidLoginMessage is the answer to every failed login, so it can't be
+// used to find out which emails have accounts
+const invalidLoginMessage = "Invalid email or password"
+
+const tooManyAttemptsMessage = "Too many login attempts, please try again later"
+
+// dummyPasswordHash is compared against when the email is unknown, so a
+// missing account takes as long to reject as a wrong password
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+const (
+	ipKeyPrefix    = "ip:"
+	emailKeyPrefix = "email:"
+)
+
+func ipAttemptKey(ip string) string {
+	return ipKeyPrefix + ip
+}
+
+func emailAttemptKey(email string) string {
+	return emailKeyPrefix + strings.ToLower(strings.TrimSpace(email))
+}
+
+// loginBackoff is the wait for key after the given number of consecutive failures
+func loginBackoff(key string, failures int) time.Duration {
+	free := accountFreeFailures
+	if strings.HasPrefix(key, ipKeyPrefix) {
+		free = ipFreeFailures
+	}
+	if failures < free {
+		return 0
+	}
+	shift := failures - free
+	if shift > 8 {
+		return maxLoginBackoff
+	}
+	wait := baseLoginBackoff << shift
+	if wait > maxLoginBackoff {
+		return maxLoginBackoff
+	}
+	return wait
+}
+
+// loginKey is a throttling key and the number of failures that locks it
+type loginKey struct {
+	key       string
+	lockAfter int
+}
+
+func ipLoginKey(ip string) loginKey {
+	return loginKey{key: ipAttemptKey(ip), lockAfter: ipLockAfter}
+}
+
+func emailLoginKey(email string) loginKey {
+	return loginKey{key: emailAttemptKey(email), lockAfter: accountLockAfter}
+}
+
+// reserveLoginAttempt checks that every key may attempt to log in now and,
+// if so, counts the attempt as a failure before the password is checked.
+// Both happen in one transaction, so a burst of parallel requests can't all
+// pass the check before any failure is recorded. A refused attempt is not
+// counted and gets how long to wait. A counted attempt that reaches a key's
+// lockout threshold locks it; the returned map holds when those locks end.
+func reserveLoginAttempt(db *sql.DB, keys ...loginKey) (time.Duration, map[string]time.Time, error) {
+	now := time.Now().UTC()
+	stamp := now.Format(time.RFC3339)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	// Writing first takes the write lock, so concurrent reservations wait for
+	// this one instead of reading the same counts
+	for _, k := range keys {
+		if _, err := tx.Exec(`
+			INSERT INTO login_attempts (attempt_key, failures, last_failure_at) VALUES (?, 0, ?)
+			ON CONFLICT(attempt_key) DO NOTHING
+		`, k.key, stamp); err != nil {
+			return 0, nil, fmt.Errorf("failed to reserve login attempt: %v", err)
+		}
+	}
+
+	failures := make([]int, len(keys))
+	var wait time.Duration
+	for i, k := range keys {
+		var lastFailureAt string
+		var lockedUntil sql.NullString
+		err := tx.QueryRow("SELECT failures, last_failure_at, locked_until FROM login_attempts WHERE attempt_key = ?",
+			k.key).Scan(&failures[i], &lastFailureAt, &lockedUntil)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if lockedUntil.Valid {
+			if until, err := time.Parse(time.RFC3339, lockedUntil.String); err == nil && until.Sub(now) > wait {
+				wait = until.Sub(now)
+			}
+		}
+		lastFailure, err := time.Parse(time.RFC3339, lastFailureAt)
+		if err != nil || now.Sub(lastFailure) > loginFailureWindow {
+			failures[i] = 0
+			continue
+		}
+		if remaining := lastFailure.Add(loginBackoff(k.key, failures[i])).Sub(now); remaining > wait {
+			wait = remaining
+		}
+	}
+	if wait > 0 {
+		return wait, nil, nil
+	}
+
+	locked := make(map[string]time.Time)
+	for i, k := range keys {
+		var err error
+		if failures[i]+1 < k.lockAfter {
+			_, err = tx.Exec("UPDATE login_attempts SET failures = ?, last_failure_at = ? WHERE attempt_key = ?",
+				failures[i]+1, stamp, k.key)
+		} else {
+			// The lockout replaces the backoff, which starts over once it ends
+			until := now.Add(loginLockout)
+			_, err = tx.Exec("UPDATE login_attempts SET failures = 0, last_failure_at = ?, locked_until = ? WHERE attempt_key = ?",
+				stamp, until.Format(time.RFC3339), k.key)
+			locked[k.key] = until
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to reserve login attempt: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return 0, locked, nil
+}
+
+// releaseLoginAttempt takes back an attempt reserved for keys once it
+// turned out not to be a failure, lifting any lock the reservation set
+func releaseLoginAttempt(db *sql.DB, locked map[string]time.Time, keys ...loginKey) {
+	for _, k := range keys {
+		var err error
+		if _, ok := locked[k.key]; ok {
+			_, err = db.Exec("UPDATE login_attempts SET failures = ?, locked_until = NULL WHERE attempt_key = ?",
+				k.lockAfter-1, k.key)
+		} else {
+			_, err = db.Exec("UPDATE login_attempts SET failures = MAX(failures - 1, 0) WHERE attempt_key = ?", k.key)
+		}
+		if err != nil {
+			log.Printf("Failed to release login attempt: %v", err)
+		}
+	}
+}
+
+// clearLoginFailures forgets the failures of key after a successful login
+func clearLoginFailures(db *sql.DB, key string) {
+	if _, err := db.Exec("DELETE FROM login_attempts WHERE attempt_key = ?", key); err != nil {
+		log.Printf("Failed to clear login failures: %v", err)
+	}
+}
+
+// pruneLoginAttempts deletes attempts that no longer throttle anything
+func pruneLoginAttempts(db *sql.DB) error {
+	now := time.Now().UTC()
+	_, err := db.Exec(`
+		DELETE FROM login_attempts
+		WHERE last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)
+	`, now.Add(-loginFailureWindow).Format(time.RFC3339), now.Format(time.RFC3339))
+	return err
+}
@@ -0,0 +1,135 @@
+package sessions
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	account, ip := emailAttemptKey("a@example.com"), ipAttemptKey("192.0.2.1")
+	tests := []struct {
+		key      string
+		failures int
+		want     time.Duration
+	}{
+		{account, 0, 0},
+		{account, accountFreeFailures - 1, 0},
+		{account, accountFreeFailures, baseLoginBackoff},
+		{account, accountFreeFailures + 1, 2 * baseLoginBackoff},
+		{account, accountFreeFailures + 4, 16 * baseLoginBackoff},
+		{account, accountFreeFailures + 9, maxLoginBackoff},
+		{account, 1000, maxLoginBackoff},
+		{ip, accountFreeFailures, 0},
+		{ip, ipFreeFailures - 1, 0},
+		{ip, ipFreeFailures, baseLoginBackoff},
+		{ip, ipFreeFailures + 2, 4 * baseLoginBackoff},
+	}
+	for _, tt := range tests {
+		if got := loginBackoff(tt.key, tt.failures); got != tt.want {
+			t.Errorf("loginBackoff(%s, %d) = %v, want %v", tt.key, tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestReserveLoginAttemptBacksOff(t *testing.T) {
+	db := newTestDB(t)
+	key := emailLoginKey("A@Example.com ")
+
+	for i := 0; i < accountFreeFailures; i++ {
+		wait, _, err := reserveLoginAttempt(db, key)
+		if err != nil {
+			t.Fatalf("reserveLoginAttempt: %v", err)
+		}
+		if wait != 0 {
+			t.Fatalf("attempt %d had to wait %v within the free failures", i+1, wait)
+		}
+	}
+
+	wait, _, err := reserveLoginAttempt(db, key)
+	if err != nil {
+		t.Fatalf("reserveLoginAttempt: %v", err)
+	}
+	if wait <= 0 || wait > baseLoginBackoff {
+		t.Fatalf("got wait %v, want up to %v", wait, baseLoginBackoff)
+	}
+
+	// A refused attempt is not counted, and a released one is taken back
+	var failures int
+	if err := db.QueryRow("SELECT failures FROM login_attempts WHERE attempt_key = ?", key.key).Scan(&failures); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if failures != accountFreeFailures {
+		t.Fatalf("got %d failures, want %d", failures, accountFreeFailures)
+	}
+	releaseLoginAttempt(db, nil, key)
+	if err := db.QueryRow("SELECT failures FROM login_attempts WHERE attempt_key = ?", key.key).Scan(&failures); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if failures != accountFreeFailures-1 {
+		t.Fatalf("got %d failures after release, want %d", failures, accountFreeFailures-1)
+	}
+}
+
+func TestReserveLoginAttemptLocks(t *testing.T) {
+	db := newTestDB(t)
+	key := emailLoginKey("a@example.com")
+
+	// Start one failure short of the lockout, outside any backoff
+	old := time.Now().UTC().Add(-10 * time.Minute).Format(time.RFC3339)
+	if _, err := db.Exec("INSERT INTO login_attempts (attempt_key, failures, last_failure_at) VALUES (?, ?, ?)",
+		key.key, accountLockAfter-1, old); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	wait, locked, err := reserveLoginAttempt(db, key)
+	if err != nil || wait != 0 {
+		t.Fatalf("got wait %v, err %v, want the attempt to go ahead", wait, err)
+	}
+	until, ok := locked[key.key]
+	if !ok || until.Sub(time.Now()) < loginLockout-time.Minute {
+		t.Fatalf("got locks %v, want %s locked for %v", locked, key.key, loginLockout)
+	}
+	if wait, _, _ := reserveLoginAttempt(db, key); wait < loginLockout-time.Minute {
+		t.Fatalf("locked key only has to wait %v", wait)
+	}
+
+	// The right password lifts the lock the attempt caused, leaving the
+	// backoff of the failures before it
+	releaseLoginAttempt(db, locked, key)
+	wait, _, err = reserveLoginAttempt(db, key)
+	if err != nil || wait <= 0 || wait > loginBackoff(key.key, accountLockAfter-1) {
+		t.Fatalf("after release got wait %v, err %v, want the backoff of %d failures", wait, err, accountLockAfter-1)
+	}
+}
+
+func TestReserveLoginAttemptIsAtomic(t *testing.T) {
+	db := newTestDB(t)
+	keys := []loginKey{ipLoginKey("192.0.2.1"), emailLoginKey("a@example.com")}
+
+	const parallel = 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, _, err := reserveLoginAttempt(db, keys...)
+			if err != nil {
+				t.Errorf("reserveLoginAttempt: %v", err)
+				return
+			}
+			if wait == 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != accountFreeFailures {
+		t.Fatalf("%d of %d parallel attempts went ahead, want %d", allowed, parallel, accountFreeFailures)
+	}
+}
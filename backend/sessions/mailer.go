@@ -0,0 +1,75 @@
+package sessions
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends plain text email
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer delivers mail through an SMTP server. Username may be empty for
+// servers that don't require authentication.
+type SMTPMailer struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP address %q: %v", m.Addr, err)
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, buildMessage(m.From, to, subject, body))
+}
+
+// LogMailer is for local development: it appends each message to Path, or
+// writes it to the log when Path is empty, instead of sending it
+type LogMailer struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	msg := buildMessage("socialhub", to, subject, body)
+	if m.Path == "" {
+		log.Printf("Mail not sent (no SMTP configured):\n%s", msg)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s\n----\n", msg)
+	return err
+}
+
+func buildMessage(from, to, subject, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
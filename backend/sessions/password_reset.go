@@ -0,0 +1,213 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultResetTokenTTL = time.Hour
+	minPasswordLength    = 8
+)
+
+// resetRequestedMessage is the answer to every reset request, so it can't be
+// used to find out which emails have accounts
+const resetRequestedMessage = "If an account exists for that email, a reset link has been sent"
+
+// newSecretToken returns a random token to hand out and the hash that is stored
+func newSecretToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashSecretToken(token), nil
+}
+
+func hashSecretToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (h *AuthHandler) resetTokenTTL() time.Duration {
+	if h.ResetTokenTTL > 0 {
+		return h.ResetTokenTTL
+	}
+	return defaultResetTokenTTL
+}
+
+// RequestPasswordReset - POST /password-reset/request {"email": "..."}
+// emails a single-use reset link. Requests are throttled like logins, per IP
+// and per email. The reply is the same whether or not the email belongs to an
+// account, and comes before anything is looked up or mailed.
+func (h *AuthHandler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Email) == "" {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+
+	// A reset request is never taken back, so it counts like a failed login
+	if _, allowed := h.reserveLogin(w, ClientIP(r), email); !allowed {
+		return
+	}
+	go h.sendResetIfAccount(email)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": resetRequestedMessage})
+}
+
+// sendResetIfAccount mails a reset link if email belongs to an account
+func (h *AuthHandler) sendResetIfAccount(email string) {
+	var userID int
+	err := h.DB.QueryRow("SELECT uid FROM users WHERE email = ?", email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.Printf("Password reset lookup failed: %v", err)
+		return
+	}
+	if err := h.sendResetToken(userID, email); err != nil {
+		log.Printf("Failed to send password reset to user %d: %v", userID, err)
+	}
+}
+
+// sendResetToken replaces any outstanding tokens of userID with a new one and mails it
+func (h *AuthHandler) sendResetToken(userID int, email string) error {
+	if h.Mailer == nil {
+		return fmt.Errorf("no mailer configured")
+	}
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	expiresAt := now.Add(h.resetTokenTTL())
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM password_reset_tokens WHERE user_id = ? AND used_at IS NULL", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO password_reset_tokens (user_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		userID, hash, now.Format(time.RFC3339), expiresAt.Format(time.RFC3339),
+	); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	link := h.ResetURL + "?token=" + token
+	body := fmt.Sprintf("Someone asked to reset the password of your account.\n\n"+
+		"Open this link to choose a new password:\n%s\n\n"+
+		"The link works once and expires at %s. If you didn't ask for this, you can ignore this email.\n",
+		link, expiresAt.Format(time.RFC1123))
+	return h.Mailer.Send(email, "Reset your password", body)
+}
+
+// ConfirmPasswordReset - POST /password-reset/confirm {"token": "...", "password": "..."}
+// sets a new password and signs the user out everywhere
+func (h *AuthHandler) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	userID, err := h.redeemResetToken(req.Token, string(hashed))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Password reset failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.SessionStore.DeleteSessionsByUserID(userID); err != nil {
+		log.Printf("Failed to revoke sessions of user %d after password reset: %v", userID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password has been reset"})
+}
+
+// redeemResetToken spends token, stores the new password hash and drops the
+// user's pending second factor logins in one transaction. It returns
+// sql.ErrNoRows for unknown, used or expired tokens.
+func (h *AuthHandler) redeemResetToken(token, passwordHash string) (int, error) {
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	var id, userID int
+	err = tx.QueryRow(`
+		SELECT id, user_id FROM password_reset_tokens
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?
+	`, hashSecretToken(token), now).Scan(&id, &userID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Checking used_at again makes a concurrent second use fail here
+	result, err := tx.Exec("UPDATE password_reset_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL", now, id)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return 0, sql.ErrNoRows
+	}
+	if _, err := tx.Exec("UPDATE users SET password = ? WHERE uid = ?", passwordHash, userID); err != nil {
+		return 0, err
+	}
+	// They passed the old password, which no longer proves anything
+	if _, err := tx.Exec("DELETE FROM login_challenges WHERE user_id = ?", userID); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
@@ -0,0 +1,148 @@
+package sessions
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingMailer keeps the last message instead of sending it
+type recordingMailer struct {
+	to, body string
+}
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.to, m.body = to, body
+	return nil
+}
+
+var resetLink = regexp.MustCompile(`\?token=(\S+)`)
+
+// issueResetToken mails a reset link for user 1 and returns its token
+func issueResetToken(t *testing.T, h *AuthHandler) string {
+	t.Helper()
+	mailer := &recordingMailer{}
+	h.Mailer = mailer
+	if err := h.sendResetToken(1, "a@example.com"); err != nil {
+		t.Fatalf("sendResetToken: %v", err)
+	}
+	match := resetLink.FindStringSubmatch(mailer.body)
+	if mailer.to != "a@example.com" || match == nil {
+		t.Fatalf("got mail to %q with body %q, want a reset link", mailer.to, mailer.body)
+	}
+	return match[1]
+}
+
+func newResetTestHandler(t *testing.T) (*AuthHandler, *sql.DB) {
+	t.Helper()
+	db := newTestDB(t)
+	if _, err := db.Exec("INSERT INTO users (uid, nickname, email, password) VALUES (1, 'a', 'a@example.com', 'old hash')"); err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	return &AuthHandler{DB: db, SessionStore: &SessionStore{DB: db}, ResetURL: "http://localhost/reset"}, db
+}
+
+func storedPasswordHash(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	var hash string
+	if err := db.QueryRow("SELECT password FROM users WHERE uid = 1").Scan(&hash); err != nil {
+		t.Fatalf("query password: %v", err)
+	}
+	return hash
+}
+
+func TestResetTokenIsStoredHashed(t *testing.T) {
+	h, db := newResetTestHandler(t)
+	token := issueResetToken(t, h)
+
+	var stored string
+	if err := db.QueryRow("SELECT token_hash FROM password_reset_tokens WHERE user_id = 1").Scan(&stored); err != nil {
+		t.Fatalf("query token: %v", err)
+	}
+	if stored == token || stored != hashSecretToken(token) {
+		t.Fatalf("stored %q for token %q, want only its hash", stored, token)
+	}
+
+	// A new request replaces the outstanding token
+	issueResetToken(t, h)
+	if _, err := h.redeemResetToken(token, "new hash"); err != sql.ErrNoRows {
+		t.Fatalf("replaced token: got %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestRedeemResetTokenIsSingleUse(t *testing.T) {
+	h, db := newResetTestHandler(t)
+	token := issueResetToken(t, h)
+
+	userID, err := h.redeemResetToken(token, "new hash")
+	if err != nil || userID != 1 {
+		t.Fatalf("redeemResetToken = %d, %v, want user 1", userID, err)
+	}
+	if got := storedPasswordHash(t, db); got != "new hash" {
+		t.Fatalf("password hash is %q, want the new one", got)
+	}
+
+	if _, err := h.redeemResetToken(token, "second hash"); err != sql.ErrNoRows {
+		t.Fatalf("second use: got %v, want sql.ErrNoRows", err)
+	}
+	if got := storedPasswordHash(t, db); got != "new hash" {
+		t.Fatalf("second use changed the password to %q", got)
+	}
+}
+
+func TestRedeemResetTokenRejectsExpiredTokens(t *testing.T) {
+	h, db := newResetTestHandler(t)
+	token := issueResetToken(t, h)
+	if _, err := db.Exec("UPDATE password_reset_tokens SET expires_at = ?",
+		time.Now().UTC().Add(-time.Minute).Format(time.RFC3339)); err != nil {
+		t.Fatalf("expire token: %v", err)
+	}
+
+	if _, err := h.redeemResetToken(token, "new hash"); err != sql.ErrNoRows {
+		t.Fatalf("got %v, want sql.ErrNoRows", err)
+	}
+	if got := storedPasswordHash(t, db); got != "old hash" {
+		t.Fatalf("expired token changed the password to %q", got)
+	}
+}
+
+func TestConfirmPasswordResetSignsOutEverywhere(t *testing.T) {
+	h, db := newResetTestHandler(t)
+	var revoked []string
+	h.SessionStore.OnRevoke = func(ids []string) { revoked = append(revoked, ids...) }
+	now := time.Now()
+	insertTestSession(t, db, "laptop", now, now.Add(time.Hour), time.Time{})
+	insertTestSession(t, db, "phone", now, now.Add(time.Hour), time.Time{})
+	if _, err := db.Exec("INSERT INTO login_challenges (user_id, token_hash, created_at, expires_at) VALUES (1, 'pending', ?, ?)",
+		now.UTC().Format(time.RFC3339), now.UTC().Add(time.Minute).Format(time.RFC3339)); err != nil {
+		t.Fatalf("insert challenge: %v", err)
+	}
+	token := issueResetToken(t, h)
+
+	body := `{"token": "` + token + `", "password": "a new password"}`
+	w := httptest.NewRecorder()
+	h.ConfirmPasswordReset(w, httptest.NewRequest(http.MethodPost, "/password-reset/confirm", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	for _, id := range []string{"laptop", "phone"} {
+		if sessionExists(t, db, id) {
+			t.Errorf("session %s survived the reset", id)
+		}
+	}
+	if len(revoked) != 2 {
+		t.Errorf("OnRevoke got %v, want both sessions", revoked)
+	}
+	var challenges int
+	if err := db.QueryRow("SELECT COUNT(*) FROM login_challenges WHERE user_id = 1").Scan(&challenges); err != nil {
+		t.Fatalf("query challenges: %v", err)
+	}
+	if challenges != 0 {
+		t.Errorf("%d pending second factor logins survived the reset", challenges)
+	}
+}
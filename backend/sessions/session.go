@@ -2,21 +2,46 @@ package sessions
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// Default session lifetimes. A session expires after DefaultIdleTimeout
+// without use, and after DefaultMaxLifetime however active it is.
+const (
+	DefaultIdleTimeout = 24 * time.Hour
+	DefaultMaxLifetime = 30 * 24 * time.Hour
+)
+
+var ErrSessionExpired = errors.New("session expired")
+
 type Session struct {
 	ID        string
 	UserID    int
 	ExpiresAt time.Time
+	CreatedAt time.Time
+	// LastSeen is zero when the session has never been used
+	LastSeen time.Time
+
+	// Renewed is set when Validate moved ExpiresAt forward
+	Renewed bool
 }
 
 type SessionStore struct {
 	DB *sql.DB
+
+	// IdleTimeout and MaxLifetime override the defaults when set
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+
+	// OnRevoke, when set, is called with the ids of sessions that were just
+	// deleted so connections opened with them can be closed
+	OnRevoke func(sessionIDs []string)
 }
 
 var SessionStoreInstance *SessionStore
@@ -25,6 +50,20 @@ func CreateSessionStore(db *sql.DB) *SessionStore {
 	return &SessionStore{DB: db}
 }
 
+func (ss *SessionStore) idleTimeout() time.Duration {
+	if ss.IdleTimeout > 0 {
+		return ss.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+func (ss *SessionStore) maxLifetime() time.Duration {
+	if ss.MaxLifetime > 0 {
+		return ss.MaxLifetime
+	}
+	return DefaultMaxLifetime
+}
+
 // GetUserIDFromSession extracts the user ID from the session cookie
 func (ss *SessionStore) GetUserIDFromSession(r *http.Request) (int, error) {
 	cookie, err := r.Cookie("session_id")
@@ -32,25 +71,103 @@ func (ss *SessionStore) GetUserIDFromSession(r *http.Request) (int, error) {
 		return -1, err
 	}
 
-	session, err := ss.GetSession(cookie.Value)
+	session, err := ss.Validate(cookie.Value)
 	if err != nil {
 		return -1, err
 	}
+	return session.UserID, nil
+}
+
+// Validate is the one place a session token is checked. It rejects unknown
+// tokens and deletes sessions past their idle expiry or maximum lifetime.
+// A valid session slides: once less than half of the idle timeout is left,
+// its expiry moves to a full idle timeout from now, capped by the maximum
+// lifetime. The returned session carries the new expiry. last_seen_at is
+// only written once it is lastSeenResolution old, so most requests read
+// the session without writing to it.
+func (ss *SessionStore) Validate(sessionID string) (*Session, error) {
+	session, err := ss.GetSession(sessionID)
+	if err != nil || session.UserID == 0 {
+		return nil, fmt.Errorf("invalid session")
+	}
 
-	// Check if session is expired
-	if time.Now().After(session.ExpiresAt) {
+	now := time.Now()
+	deadline := session.CreatedAt.Add(ss.maxLifetime())
+	if !now.Before(session.ExpiresAt) || !now.Before(deadline) {
 		ss.DeleteSession(session.ID)
-		return -1, fmt.Errorf("session expired")
+		return nil, ErrSessionExpired
 	}
 
-	return session.UserID, nil
+	if session.ExpiresAt.Sub(now) < ss.idleTimeout()/2 {
+		renewed := now.Add(ss.idleTimeout())
+		if renewed.After(deadline) {
+			renewed = deadline
+		}
+		if renewed.After(session.ExpiresAt) {
+			if _, err := ss.DB.Exec("UPDATE sessions SET expires_at = ? WHERE session = ?", renewed, session.ID); err != nil {
+				log.Printf("Failed to renew session: %v", err)
+			} else {
+				session.ExpiresAt = renewed
+				session.Renewed = true
+			}
+		}
+	}
+	if now.Sub(session.LastSeen) >= lastSeenResolution {
+		ss.Touch(session.ID)
+	}
+	return session, nil
+}
+
+// setSessionCookie sends the session cookie, expiring with the session
+func setSessionCookie(w http.ResponseWriter, session *Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_id",
+		Value:    session.ID,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+	})
 }
 
-func (ss *SessionStore) CreateSession(userID int) (*Session, error) {
+// DeleteExpired removes every session past its expiry or maximum lifetime
+func (ss *SessionStore) DeleteExpired() error {
+	cutoff := fmt.Sprintf("-%d seconds", int(ss.maxLifetime()/time.Second))
+	return ss.deleteWhere("julianday(expires_at) <= julianday('now') OR julianday(timestamp) <= julianday('now', ?)", cutoff)
+}
+
+// StartReaper deletes expired sessions every interval, closing any
+// connections still using them through OnRevoke
+func (ss *SessionStore) StartReaper(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := ss.DeleteExpired(); err != nil {
+				log.Printf("Failed to delete expired sessions: %v", err)
+			}
+			if err := pruneLoginAttempts(ss.DB); err != nil {
+				log.Printf("Failed to prune login attempts: %v", err)
+			}
+			if err := pruneLoginChallenges(ss.DB); err != nil {
+				log.Printf("Failed to prune login challenges: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// CreateSession starts a session for userID on the device described by
+// userAgent and ip
+func (ss *SessionStore) CreateSession(userID int, userAgent, ip string) (*Session, error) {
 	id := uuid.New().String()
-	expiresAt := time.Now().Add(24 * time.Hour)
+	expiresAt := time.Now().Add(ss.idleTimeout())
 
-	err := ss.InsertSession(id, userID, expiresAt)
+	err := ss.InsertSession(id, userID, expiresAt, userAgent, ip)
 	if err != nil {
 
 		err = ss.DeleteSessionsByUserID(userID)
@@ -58,7 +175,7 @@ func (ss *SessionStore) CreateSession(userID int) (*Session, error) {
 			return nil, err
 		}
 
-		err = ss.InsertSession(id, userID, expiresAt)
+		err = ss.InsertSession(id, userID, expiresAt, userAgent, ip)
 		if err != nil {
 			fmt.Printf("err: %v\n", err)
 			return nil, err
@@ -71,55 +188,88 @@ func (ss *SessionStore) CreateSession(userID int) (*Session, error) {
 		ID:        id,
 		UserID:    userID,
 		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
 	}, nil
 }
 
-func (ss *SessionStore) InsertSession(id string, userID int, expiresAt time.Time) error {
+func (ss *SessionStore) InsertSession(id string, userID int, expiresAt time.Time, userAgent, ip string) error {
 	_, err := ss.DB.Exec(
-		"INSERT INTO sessions (session, user_id, expires_at) VALUES (?, ?, ?)", // Use 'session' column
-		id, userID, expiresAt,
+		"INSERT INTO sessions (session, user_id, expires_at, user_agent, ip, last_seen_at) VALUES (?, ?, ?, ?, ?, ?)", // Use 'session' column
+		id, userID, expiresAt, userAgent, ip, time.Now().UTC().Format(time.RFC3339),
 	)
 	return err
 }
 
 func (ss *SessionStore) GetSession(sessionID string) (*Session, error) {
 	var s Session
+	var lastSeen sql.NullString
 	err := ss.DB.QueryRow(
-		"SELECT session, user_id, expires_at FROM sessions WHERE session = ?", // Select 'session' and filter by it
+		"SELECT session, user_id, expires_at, timestamp, last_seen_at FROM sessions WHERE session = ?", // Select 'session' and filter by it
 		sessionID,
-	).Scan(&s.ID, &s.UserID, &s.ExpiresAt)
+	).Scan(&s.ID, &s.UserID, &s.ExpiresAt, &s.CreatedAt, &lastSeen)
 	if err != nil {
 		return nil, err
 	}
+	if lastSeen.Valid {
+		s.LastSeen, _ = time.Parse(time.RFC3339, lastSeen.String)
+	}
 	return &s, nil
 }
 
 func (ss *SessionStore) DeleteSession(sessionID string) error {
 	_, err := ss.DB.Exec("DELETE FROM sessions WHERE session = ?", sessionID) // Delete by 'session' column
+	if err == nil {
+		ss.revoked([]string{sessionID})
+	}
 	return err
 }
 
 func (ss *SessionStore) DeleteSessionsByUserID(userID int) error {
-	_, err := ss.DB.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
-	return err
+	return ss.deleteWhere("user_id = ?", userID)
 }
 
-func GetUserIDFromSession(r *http.Request) (int, error) {
-	cookie, err := r.Cookie("session_id")
+// deleteWhere deletes the sessions matching cond and reports them to OnRevoke
+func (ss *SessionStore) deleteWhere(cond string, args ...interface{}) error {
+	tx, err := ss.DB.Begin()
 	if err != nil {
-		return -1, err
+		return err
 	}
+	defer tx.Rollback()
 
-	session, err := SessionStoreInstance.GetSession(cookie.Value)
+	rows, err := tx.Query("SELECT session FROM sessions WHERE "+cond, args...)
 	if err != nil {
-		return -1, fmt.Errorf("invalid session")
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	// Check if session is expired
-	if time.Now().After(session.ExpiresAt) {
-		SessionStoreInstance.DeleteSession(session.ID)
-		return -1, fmt.Errorf("session expired")
+	if _, err := tx.Exec("DELETE FROM sessions WHERE "+cond, args...); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
 	}
+	ss.revoked(ids)
+	return nil
+}
 
-	return session.UserID, nil
+func (ss *SessionStore) revoked(ids []string) {
+	if ss.OnRevoke != nil && len(ids) > 0 {
+		ss.OnRevoke(ids)
+	}
+}
+
+func GetUserIDFromSession(r *http.Request) (int, error) {
+	return SessionStoreInstance.GetUserIDFromSession(r)
 }
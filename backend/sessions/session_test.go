@@ -0,0 +1,186 @@
+package sessions
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// testSchema holds the tables the sessions package uses, as the migrations
+// leave them
+const testSchema = `
+CREATE TABLE sessions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	session TEXT,
+	expires_at DATETIME,
+	user_id INTEGER,
+	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '',
+	last_seen_at TEXT
+);
+CREATE TABLE users (
+	uid INTEGER PRIMARY KEY AUTOINCREMENT,
+	nickname TEXT UNIQUE,
+	email TEXT NOT NULL UNIQUE,
+	password TEXT NOT NULL
+);
+CREATE TABLE login_attempts (
+	attempt_key TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL DEFAULT 0,
+	last_failure_at TEXT NOT NULL,
+	locked_until TEXT
+);
+CREATE TABLE password_reset_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	created_at TEXT NOT NULL,
+	expires_at TEXT NOT NULL,
+	used_at TEXT
+);
+CREATE TABLE login_challenges (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	created_at TEXT NOT NULL,
+	expires_at TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0
+);
+`
+
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := db.Exec(testSchema); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// insertTestSession stores a session created at createdAt, expiring at
+// expiresAt and last used at lastSeen, if set
+func insertTestSession(t *testing.T, db *sql.DB, id string, createdAt, expiresAt, lastSeen time.Time) {
+	t.Helper()
+	var seen interface{}
+	if !lastSeen.IsZero() {
+		seen = lastSeen.UTC().Format(time.RFC3339)
+	}
+	if _, err := db.Exec("INSERT INTO sessions (session, user_id, expires_at, timestamp, last_seen_at) VALUES (?, 1, ?, ?, ?)",
+		id, expiresAt, createdAt, seen); err != nil {
+		t.Fatalf("insert session: %v", err)
+	}
+}
+
+func sessionExists(t *testing.T, db *sql.DB, id string) bool {
+	t.Helper()
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM sessions WHERE session = ?)", id).Scan(&exists); err != nil {
+		t.Fatalf("query session: %v", err)
+	}
+	return exists
+}
+
+func TestValidateRejectsExpiredSessions(t *testing.T) {
+	db := newTestDB(t)
+	ss := &SessionStore{DB: db, IdleTimeout: time.Hour, MaxLifetime: 24 * time.Hour}
+	now := time.Now()
+
+	insertTestSession(t, db, "idle", now.Add(-2*time.Hour), now.Add(-time.Second), time.Time{})
+	insertTestSession(t, db, "old", now.Add(-25*time.Hour), now.Add(time.Hour), time.Time{})
+
+	for _, id := range []string{"idle", "old"} {
+		if _, err := ss.Validate(id); !errors.Is(err, ErrSessionExpired) {
+			t.Errorf("Validate(%s) = %v, want ErrSessionExpired", id, err)
+		}
+		if sessionExists(t, db, id) {
+			t.Errorf("expired session %s was not deleted", id)
+		}
+	}
+	if _, err := ss.Validate("unknown"); err == nil {
+		t.Error("Validate accepted an unknown session")
+	}
+}
+
+func TestValidateSlidesExpiry(t *testing.T) {
+	db := newTestDB(t)
+	ss := &SessionStore{DB: db, IdleTimeout: time.Hour, MaxLifetime: 24 * time.Hour}
+	now := time.Now()
+
+	// More than half the idle timeout left: nothing changes
+	insertTestSession(t, db, "fresh", now, now.Add(50*time.Minute), time.Time{})
+	session, err := ss.Validate("fresh")
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if session.Renewed {
+		t.Error("session with most of its idle timeout left was renewed")
+	}
+
+	// Less than half left: a full idle timeout from now
+	insertTestSession(t, db, "stale", now, now.Add(10*time.Minute), time.Time{})
+	session, err = ss.Validate("stale")
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if !session.Renewed || session.ExpiresAt.Before(now.Add(59*time.Minute)) {
+		t.Errorf("got expiry %v renewed=%v, want about an hour from now", session.ExpiresAt, session.Renewed)
+	}
+	stored, err := ss.GetSession("stale")
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if !stored.ExpiresAt.Equal(session.ExpiresAt) {
+		t.Errorf("stored expiry %v, want %v", stored.ExpiresAt, session.ExpiresAt)
+	}
+
+	// Renewal never goes past the maximum lifetime
+	created := now.Add(-(24*time.Hour - 20*time.Minute))
+	insertTestSession(t, db, "ending", created, now.Add(10*time.Minute), time.Time{})
+	session, err = ss.Validate("ending")
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if deadline := created.Add(24 * time.Hour); session.ExpiresAt.After(deadline.Add(time.Second)) {
+		t.Errorf("got expiry %v, past the maximum lifetime %v", session.ExpiresAt, deadline)
+	}
+}
+
+func TestValidateTouchesOnlyWhenDue(t *testing.T) {
+	db := newTestDB(t)
+	ss := &SessionStore{DB: db, IdleTimeout: time.Hour}
+	now := time.Now()
+
+	recent := now.Add(-10 * time.Second).UTC().Truncate(time.Second)
+	insertTestSession(t, db, "recent", now, now.Add(time.Hour), recent)
+	insertTestSession(t, db, "stale", now, now.Add(time.Hour), now.Add(-5*time.Minute))
+
+	for _, id := range []string{"recent", "stale"} {
+		if _, err := ss.Validate(id); err != nil {
+			t.Fatalf("Validate(%s): %v", id, err)
+		}
+	}
+
+	got, err := ss.GetSession("recent")
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if !got.LastSeen.Equal(recent) {
+		t.Errorf("recently used session was touched: last seen %v, want %v", got.LastSeen, recent)
+	}
+	got, err = ss.GetSession("stale")
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if now.Sub(got.LastSeen) > 2*time.Second {
+		t.Errorf("stale session was not touched: last seen %v", got.LastSeen)
+	}
+}
@@ -0,0 +1,89 @@
+package sessions
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238). These are the defaults every authenticator app
+// understands; a code from the step before or after the current one is
+// accepted to allow for clock drift.
+const (
+	totpIssuer = "SocialHub"
+	totpDigits = 6
+	totpPeriod = 30 * time.Second
+	totpSkew   = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random 160-bit secret in base32
+func newTOTPSecret() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+// totpURI is the otpauth:// URI authenticator apps import, usually from a QR code
+func totpURI(account, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+account) + "?" + params.Encode()
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod/time.Second)
+}
+
+// totpCode computes the code of secret for one time step (RFC 4226)
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus), nil
+}
+
+// matchTOTP returns the time step code is valid for at now, if any
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,85 @@
+package sessions
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 key of the RFC 6238 test vectors, "12345678901234567890"
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// The RFC lists 8 digit codes; 6 digit codes are their last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, totpStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("totpCode at %d: %v", tt.unix, err)
+		}
+		if want := tt.want[len(tt.want)-totpDigits:]; got != want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := totpStep(now)
+	code := func(s int64) string {
+		c, err := totpCode(rfc6238Secret, s)
+		if err != nil {
+			t.Fatalf("totpCode: %v", err)
+		}
+		return c
+	}
+
+	for offset := int64(-totpSkew); offset <= totpSkew; offset++ {
+		got, ok := matchTOTP(rfc6238Secret, code(step+offset), now)
+		if !ok || got != step+offset {
+			t.Errorf("code from step %+d: got step %d ok=%v, want %d", offset, got, ok, step+offset)
+		}
+	}
+	for _, offset := range []int64{-totpSkew - 1, totpSkew + 1} {
+		if _, ok := matchTOTP(rfc6238Secret, code(step+offset), now); ok {
+			t.Errorf("code from step %+d was accepted", offset)
+		}
+	}
+
+	if _, ok := matchTOTP(strings.ToLower(rfc6238Secret), code(step), now); !ok {
+		t.Error("lowercase secret was not accepted")
+	}
+	for _, bad := range []string{"", "12345", "1234567", code(step) + "0"} {
+		if _, ok := matchTOTP(rfc6238Secret, bad, now); ok {
+			t.Errorf("malformed code %q was accepted", bad)
+		}
+	}
+	if _, ok := matchTOTP("not base32!", "123456", now); ok {
+		t.Error("code for an invalid secret was accepted")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := totpURI("a@example.com", "JBSWY3DPEHPK3PXP")
+	for _, part := range []string{
+		"otpauth://totp/SocialHub:a@example.com?",
+		"secret=JBSWY3DPEHPK3PXP",
+		"issuer=SocialHub",
+		"digits=6",
+		"period=30",
+	} {
+		if !strings.Contains(uri, part) {
+			t.Errorf("uri %q lacks %q", uri, part)
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	recoveryCodeCount    = 10
+	loginChallengeTTL    = 5 * time.Minute
+	maxChallengeAttempts = 5
+)
+
+// confirmPassword checks that password is userID's current password. Wrong
+// passwords count against the account like failed logins, so a stolen session
+// can't be used to guess it. It answers the request unless the password is right.
+func (h *AuthHandler) confirmPassword(w http.ResponseWriter, userID int, password string) bool {
+	var hash, email string
+	if err := h.DB.QueryRow("SELECT password, email FROM users WHERE uid = ?", userID).Scan(&hash, &email); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+
+	key := emailLoginKey(email)
+	wait, locked, err := reserveLoginAttempt(h.DB, key)
+	if err != nil {
+		log.Printf("Login throttle lookup failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+	if wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		h.loginFailed(email, userID, locked)
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return false
+	}
+	releaseLoginAttempt(h.DB, locked, key)
+	return true
+}
+
+// twoFactorEnabled reports whether userID has a confirmed TOTP secret
+func (h *AuthHandler) twoFactorEnabled(userID int) (bool, error) {
+	var enabled bool
+	err := h.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = ? AND enabled_at IS NOT NULL)",
+		userID).Scan(&enabled)
+	return enabled, err
+}
+
+// newRecoveryCode returns a random code such as "k3m9q-x7p2d"
+func newRecoveryCode() (string, error) {
+	buf := make([]byte, 7)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(totpEncoding.EncodeToString(buf))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// normalizeRecoveryCode lets codes be typed without the dash or in capitals
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// replaceRecoveryCodes stores new recovery codes for userID, dropping any old
+// ones. Only their hashes are kept; the codes are returned to show once.
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for len(codes) < recoveryCodeCount {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES (?, ?)",
+			userID, hashSecretToken(normalizeRecoveryCode(code))); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// useRecoveryCode spends one of userID's unused recovery codes
+func (h *AuthHandler) useRecoveryCode(userID int, code string) (bool, error) {
+	result, err := h.DB.Exec(`
+		UPDATE totp_recovery_codes SET used_at = ?
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, time.Now().UTC().Format(time.RFC3339), userID, hashSecretToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// useTOTPCode checks code against userID's confirmed secret, or the pending
+// one when confirmed is false. Each time step is accepted only once.
+func (h *AuthHandler) useTOTPCode(userID int, code string, confirmed bool) (bool, error) {
+	query := "SELECT secret, last_used_step FROM user_totp WHERE user_id = ? AND enabled_at IS NOT NULL"
+	if !confirmed {
+		query = "SELECT secret, last_used_step FROM user_totp WHERE user_id = ? AND enabled_at IS NULL"
+	}
+	var secret string
+	var lastStep int64
+	err := h.DB.QueryRow(query, userID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := matchTOTP(secret, strings.TrimSpace(code), time.Now())
+	if !ok || step <= lastStep {
+		return false, nil
+	}
+	// Checking last_used_step again makes a concurrent second use fail here
+	result, err := h.DB.Exec("UPDATE user_totp SET last_used_step = ? WHERE user_id = ? AND last_used_step < ?",
+		step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// verifySecondFactor accepts a current TOTP code or an unused recovery code
+func (h *AuthHandler) verifySecondFactor(userID int, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		return h.useTOTPCode(userID, code, true)
+	}
+	return h.useRecoveryCode(userID, code)
+}
+
+// createLoginChallenge records that userID passed the password check and
+// returns the token that completes the login with a second factor
+func (h *AuthHandler) createLoginChallenge(userID int) (string, error) {
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	_, err = h.DB.Exec(
+		"INSERT INTO login_challenges (user_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		userID, hash, now.Format(time.RFC3339), now.Add(loginChallengeTTL).Format(time.RFC3339),
+	)
+	return token, err
+}
+
+// pruneLoginChallenges deletes challenges that can no longer be completed
+func pruneLoginChallenges(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM login_challenges WHERE expires_at <= ?", time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// LoginTwoFactor - POST /login/2fa {"challenge": "...", "code": "123456"}
+// completes a login that Login answered with two_factor_required. The code
+// is either from the authenticator app or one of the recovery codes.
+func (h *AuthHandler) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Challenge == "" || req.Code == "" {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	var challengeID, userID, attempts int
+	var email, nickname string
+	err := h.DB.QueryRow(`
+		SELECT c.id, c.user_id, c.attempts, u.email, u.nickname
+		FROM login_challenges c JOIN users u ON u.uid = c.user_id
+		WHERE c.token_hash = ? AND c.expires_at > ?
+	`, hashSecretToken(req.Challenge), time.Now().UTC().Format(time.RFC3339)).Scan(&challengeID, &userID, &attempts, &email, &nickname)
+	if err == sql.ErrNoRows {
+		writeLoginError(w, http.StatusUnauthorized, "Login expired, please sign in again")
+		return
+	}
+	if err != nil {
+		log.Printf("Login challenge lookup failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	ip := ClientIP(r)
+	locked, allowed := h.reserveLogin(w, ip, email)
+	if !allowed {
+		return
+	}
+
+	ok, err := h.verifySecondFactor(userID, req.Code)
+	if err != nil {
+		log.Printf("Two-factor check failed for user %d: %v", userID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		h.loginFailed(email, userID, locked)
+		// Too many wrong codes send the user back to the password step
+		if attempts+1 >= maxChallengeAttempts {
+			_, err = h.DB.Exec("DELETE FROM login_challenges WHERE id = ?", challengeID)
+		} else {
+			_, err = h.DB.Exec("UPDATE login_challenges SET attempts = attempts + 1 WHERE id = ?", challengeID)
+		}
+		if err != nil {
+			log.Printf("Failed to update login challenge: %v", err)
+		}
+		writeLoginError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+
+	// Only the request that deletes the challenge gets a session
+	result, err := h.DB.Exec("DELETE FROM login_challenges WHERE id = ?", challengeID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		writeLoginError(w, http.StatusUnauthorized, "Login expired, please sign in again")
+		return
+	}
+	releaseLoginAttempt(h.DB, locked, ipLoginKey(ip))
+	clearLoginFailures(h.DB, emailAttemptKey(email))
+	h.startSession(w, r, userID, nickname)
+}
+
+// TwoFactorStatus - GET /2fa reports whether the caller has 2FA enabled
+func (h *AuthHandler) TwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, userID, ok := h.currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	var enabledAt sql.NullString
+	err := h.DB.QueryRow("SELECT enabled_at FROM user_totp WHERE user_id = ?", userID).Scan(&enabledAt)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	var remaining int
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM totp_recovery_codes WHERE user_id = ? AND used_at IS NULL",
+		userID).Scan(&remaining); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":                  enabledAt.Valid,
+		"pending":                  err == nil && !enabledAt.Valid,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// EnrollTwoFactor - POST /2fa/enroll {"password": "..."} starts enrollment
+// and returns the secret with its otpauth URI. 2FA is not enforced until
+// ConfirmTwoFactor sees a first code.
+func (h *AuthHandler) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, userID, ok := h.currentSession(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	if !h.confirmPassword(w, userID, req.Password) {
+		return
+	}
+	enabled, err := h.twoFactorEnabled(userID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	var email string
+	if err := h.DB.QueryRow("SELECT email FROM users WHERE uid = ?", userID).Scan(&email); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// Enrolling again before confirming replaces the pending secret
+	_, err = h.DB.Exec(`
+		INSERT INTO user_totp (user_id, secret, created_at) VALUES (?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET secret = excluded.secret, created_at = excluded.created_at, last_used_step = 0
+		WHERE enabled_at IS NULL
+	`, userID, secret, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		log.Printf("Failed to start 2FA enrollment for user %d: %v", userID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totpURI(email, secret),
+	})
+}
+
+// ConfirmTwoFactor - POST /2fa/confirm {"code": "123456"} enables 2FA once
+// the authenticator app produces a valid code, and returns the recovery
+// codes. They are shown only this once.
+func (h *AuthHandler) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, userID, ok := h.currentSession(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	var pending bool
+	if err := h.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = ? AND enabled_at IS NULL)",
+		userID).Scan(&pending); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !pending {
+		http.Error(w, "No two-factor enrollment in progress", http.StatusNotFound)
+		return
+	}
+	valid, err := h.useTOTPCode(userID, req.Code, false)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE user_totp SET enabled_at = ? WHERE user_id = ? AND enabled_at IS NULL",
+		time.Now().UTC().Format(time.RFC3339), userID); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to enable 2FA for user %d: %v", userID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTwoFactor - POST /2fa/disable {"password": "..."} turns 2FA off and
+// discards the secret and recovery codes
+func (h *AuthHandler) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, userID, ok := h.currentSession(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	if !h.confirmPassword(w, userID, req.Password) {
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("DELETE FROM user_totp WHERE user_id = ?", userID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusNotFound)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ?", userID); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM login_challenges WHERE user_id = ?", userID); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
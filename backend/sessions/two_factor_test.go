@@ -0,0 +1,58 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestConfirmPasswordIsThrottled(t *testing.T) {
+	db := newTestDB(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("right password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO users (uid, nickname, email, password) VALUES (1, 'a', 'a@example.com', ?)", hash); err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+
+	var lockedUser int
+	h := &AuthHandler{DB: db, OnLockout: func(userID int, until time.Time) { lockedUser = userID }}
+	confirm := func(password string) (bool, int) {
+		w := httptest.NewRecorder()
+		ok := h.confirmPassword(w, 1, password)
+		return ok, w.Code
+	}
+
+	if ok, code := confirm("right password"); !ok || code != http.StatusOK {
+		t.Fatalf("right password: got ok=%v status %d", ok, code)
+	}
+	for i := 0; i < accountFreeFailures; i++ {
+		if ok, code := confirm("wrong"); ok || code != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: got ok=%v status %d, want 401", i+1, ok, code)
+		}
+	}
+	// Past the free failures even the right password has to wait
+	if ok, code := confirm("right password"); ok || code != http.StatusTooManyRequests {
+		t.Fatalf("got ok=%v status %d, want 429", ok, code)
+	}
+
+	// Failures here and at login count against the same account
+	if _, err := db.Exec("UPDATE login_attempts SET failures = ?, last_failure_at = ? WHERE attempt_key = ?",
+		accountLockAfter-1, time.Now().UTC().Add(-10*time.Minute).Format(time.RFC3339),
+		emailAttemptKey("a@example.com")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if ok, code := confirm("wrong"); ok || code != http.StatusUnauthorized {
+		t.Fatalf("got ok=%v status %d, want 401", ok, code)
+	}
+	if lockedUser != 1 {
+		t.Fatalf("lockout was not reported for the account")
+	}
+	if ok, code := confirm("right password"); ok || code != http.StatusTooManyRequests {
+		t.Fatalf("locked account: got ok=%v status %d, want 429", ok, code)
+	}
+}
@@ -13,7 +13,7 @@ interface GroupNotificationsContextType {
   notifications: GroupNotification[];
   totalUnread: number;
   refreshNotifications: () => void;
-  markGroupAsRead: (groupId: number) => void;
+  markGroupAsRead: (groupId: number, messageId?: number) => void;
   forceRefresh: () => void;
 }
 
@@ -52,9 +52,10 @@ export const GroupNotificationsProvider: React.FC<GroupNotificationsProviderProp
     }
   };
 
-  const markGroupAsRead = async (groupId: number) => {
+  const markGroupAsRead = async (groupId: number, messageId?: number) => {
     try {
-      const response = await fetch(`http://localhost:8080/mark-group-read?group_id=${groupId}`, {
+      const upTo = messageId ? `&message_id=${messageId}` : '';
+      const response = await fetch(`http://localhost:8080/mark-group-read?group_id=${groupId}${upTo}`, {
         method: 'POST',
         credentials: 'include',
       });
@@ -7,6 +7,7 @@ import { useWebSocket } from "../context/WebSocketContext";
 import { useAuth } from "../context/auth";
 
 interface Message {
+  message_id?: number;
   sender: string;
   content: string;
   timestamp: string;
@@ -46,9 +47,9 @@ export default function GroupChat({ groupId, groupName }: Props) {
         }
         return res.json();
       })
-      .then((data: Message[]) => {
-        if (Array.isArray(data) && data.length > 0) {
-          setMessages(data);
+      .then((data: { messages?: Message[] }) => {
+        if (Array.isArray(data?.messages) && data.messages.length > 0) {
+          setMessages(data.messages);
         }
       })
       .catch((err) => {
@@ -28,6 +28,9 @@ export function Login() {
   const [showPassword, setShowPassword] = useState(false);
   const [errors, setErrors] = useState<ValidationErrors>({});
   const [touched, setTouched] = useState<Record<string, boolean>>({});
+  // Set when the account has two-factor authentication and the password was accepted
+  const [challenge, setChallenge] = useState<string | null>(null);
+  const [code, setCode] = useState("");
   const router = useRouter();
 
   useEffect(() => {
@@ -143,16 +146,29 @@ export function Login() {
     setIsSubmitting(true);
 
     try {
-      const response = await fetch("http://localhost:8080/login", {
-        method: "POST",
-        headers: { "Content-Type": "application/json" },
-        body: JSON.stringify({ email, password }),
-        credentials: "include",
-      });
+      const response = challenge
+        ? await fetch("http://localhost:8080/login/2fa", {
+            method: "POST",
+            headers: { "Content-Type": "application/json" },
+            body: JSON.stringify({ challenge, code: code.trim() }),
+            credentials: "include",
+          })
+        : await fetch("http://localhost:8080/login", {
+            method: "POST",
+            headers: { "Content-Type": "application/json" },
+            body: JSON.stringify({ email, password }),
+            credentials: "include",
+          });
 
       if (response.ok) {
         const data = await response.json();
 
+        if (data.two_factor_required) {
+          setChallenge(data.challenge);
+          setCode("");
+          return;
+        }
+
         setIsLoggedIn(true);
         setUser({ nickname: data.nickname });
         setIsLoading(false); 
@@ -172,6 +188,10 @@ export function Login() {
         if (contentType && contentType.includes("application/json")) {
           try {
             const errorData = await response.json();
+            // An expired challenge has to start over from the password
+            if (challenge && response.status === 401 && errorData.error !== "Invalid code") {
+              setChallenge(null);
+            }
             // Check for both 'message' and 'error' fields (backend uses 'error')
             setError(errorData.error || errorData.message || "Invalid email or password");
           } catch (jsonError) {
@@ -240,6 +260,35 @@ export function Login() {
           )}
 
           <form onSubmit={handleSubmit} className="space-y-6">
+            {challenge ? (
+            <div>
+              <label className="block text-sm font-medium text-gray-700 mb-2">
+                Authentication Code <span className="text-red-500">*</span>
+              </label>
+              <div className="relative">
+                <Shield className="absolute left-3 top-1/2 transform -translate-y-1/2 w-5 h-5 text-gray-400" />
+                <input
+                  type="text"
+                  name="code"
+                  inputMode="text"
+                  autoComplete="one-time-code"
+                  autoFocus
+                  placeholder="6-digit code or recovery code"
+                  value={code}
+                  onChange={(e) => {
+                    setCode(e.target.value);
+                    if (error) setError("");
+                  }}
+                  disabled={isSubmitting}
+                  className="w-full pl-12 pr-4 py-3 border rounded-2xl focus:outline-none focus:ring-2 disabled:bg-gray-100 disabled:cursor-not-allowed transition-all duration-200 hover:border-gray-400 border-gray-300 focus:ring-sky-500 focus:border-transparent"
+                />
+              </div>
+              <p className="mt-2 text-sm text-gray-500">
+                Enter the code from your authenticator app, or one of your recovery codes.
+              </p>
+            </div>
+            ) : (
+            <>
             <div>
               <label className="block text-sm font-medium text-gray-700 mb-2">
                 Email Address <span className="text-red-500">*</span>
@@ -291,6 +340,8 @@ export function Login() {
               </div>
               {renderError('password')}
             </div>
+            </>
+            )}
 
             <button
               type="submit"
@@ -77,7 +77,9 @@ export function Messages({ targetNickname }: { targetNickname?: string }) {
       return;
     }
 
-    fetch(`http://localhost:8080/chat/can-access?user=${currentUser}&target=${selectedContact}`)
+    fetch(`http://localhost:8080/chat/can-access?target=${encodeURIComponent(selectedContact)}`, {
+      credentials: "include",
+    })
       .then((res) => {
         if (!res.ok) throw new Error("Forbidden");
         return res.json();
@@ -93,12 +95,14 @@ export function Messages({ targetNickname }: { targetNickname?: string }) {
   useEffect(() => {
     if (!selectedContact || !currentUser) return;
 
-    fetch(`http://localhost:8080/chat/history?user1=${currentUser}&user2=${selectedContact}`)
+    fetch(`http://localhost:8080/chat/history?with=${encodeURIComponent(selectedContact)}`, {
+      credentials: "include",
+    })
       .then((res) => res.json())
       .then((data) => {
-        if (!Array.isArray(data)) return;
+        if (!data || !Array.isArray(data.messages)) return;
 
-        const formatted = data.map((msg) => ({
+        const formatted = data.messages.map((msg) => ({
           message_id: msg.message_id?.toString() || uuidv4(),
           from: msg.sender === currentUser ? "me" : selectedContact,
           text: msg.message,
@@ -207,7 +211,8 @@ export function Messages({ targetNickname }: { targetNickname?: string }) {
     fetch('http://localhost:8080/messages/mark-read', {
       method: 'POST',
       headers: { 'Content-Type': 'application/json' },
-      body: JSON.stringify({ user: currentUser, sender: user })
+      credentials: 'include',
+      body: JSON.stringify({ sender: user })
     })
       .then(() => {
         setUnreadBySender(prev => ({